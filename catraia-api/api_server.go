@@ -1,36 +1,62 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/renatofq/catraia/handlers"
+	"github.com/renatofq/catraia/metrics"
 	"github.com/renatofq/catraia/servers"
 )
 
-func NewAPIServer(name, addr string, ctrService ContainerService) servers.Server {
+func NewAPIServer(name, addr string, ctrService ContainerService,
+	opService OperationService, imgService ImageService, volService VolumeService,
+	secrets *secretStore, reconciler Reconciler,
+	netMetrics func(context.Context, io.Writer) error) servers.Server {
 
 	mux := http.NewServeMux()
 
 	chain := handlers.NewChain(handlers.LogAdapter(), handlers.CORSAdapter())
 
-	mux.Handle("/service/", chain.Then(newServiceHandler(ctrService)))
+	mux.Handle("/service/", chain.Then(newServiceHandler(ctrService, opService)))
+	mux.Handle("/operations/", chain.Then(newOperationHandler(opService)))
+	mux.Handle("/images", chain.Then(newImageHandler(imgService)))
+	mux.Handle("/images/", chain.Then(newImageHandler(imgService)))
+	mux.Handle("/volumes", chain.Then(newVolumeHandler(volService)))
+	mux.Handle("/volumes/", chain.Then(newVolumeHandler(volService)))
+	mux.Handle("/secrets/", chain.Then(newSecretHandler(secrets)))
+	mux.Handle("/reconcile/", chain.Then(newReconcileHandler(reconciler)))
+	mux.Handle("/metrics", metrics.Handler(netMetrics))
 
 	return servers.NewHTTPServer(name, addr, mux)
 }
 
 type serviceHandler struct {
 	containerService ContainerService
+	operationService OperationService
 }
 
-func newServiceHandler(containerService ContainerService) http.Handler {
-	return &serviceHandler{containerService}
+func newServiceHandler(containerService ContainerService,
+	operationService OperationService) http.Handler {
+	return &serviceHandler{containerService, operationService}
 }
 
 func (s *serviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if id, action, ok := parseServiceAction(r.URL.Path); ok {
+		s.serveAction(w, r, id, action)
+		return
+	}
+
 	switch r.Method {
 	case "OPTIONS":
 		s.optionsService(w, r)
@@ -45,6 +71,23 @@ func (s *serviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *serviceHandler) serveAction(w http.ResponseWriter, r *http.Request, id, action string) {
+	switch action {
+	case "logs":
+		s.getLogs(w, r, id)
+	case "rollback":
+		s.postRollback(w, r, id)
+	case "deploy/progress":
+		s.getDeployProgress(w, r, id)
+	case "exec":
+		s.postExec(w, r, id)
+	case "pause", "resume", "restart", "signal":
+		s.postControl(w, r, id, action)
+	default:
+		handlers.WriteError(w, http.StatusNotFound, errors.New("unknown service action"))
+	}
+}
+
 func (s *serviceHandler) optionsService(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Allow", "OPTIONS, GET, PUT, DELETE")
 	w.WriteHeader(http.StatusOK)
@@ -52,6 +95,11 @@ func (s *serviceHandler) optionsService(w http.ResponseWriter, r *http.Request)
 
 func (s *serviceHandler) getService(w http.ResponseWriter, r *http.Request) {
 
+	if r.URL.Path == "/service/" {
+		s.listServices(w, r)
+		return
+	}
+
 	id, ok := parseServiceID(r.URL.Path)
 	if !ok {
 		log.Printf("Invalid service id %s\n", id)
@@ -70,6 +118,19 @@ func (s *serviceHandler) getService(w http.ResponseWriter, r *http.Request) {
 	handlers.WriteEntity(w, http.StatusOK, info)
 }
 
+func (s *serviceHandler) listServices(w http.ResponseWriter, r *http.Request) {
+
+	statuses, err := s.containerService.List(r.Context())
+	if err != nil {
+		log.Printf("Fail to list services: %v\n", err)
+		handlers.WriteError(w, http.StatusInternalServerError,
+			errors.New("fail to list services"))
+		return
+	}
+
+	handlers.WriteEntity(w, http.StatusOK, statuses)
+}
+
 func (s *serviceHandler) putService(w http.ResponseWriter, r *http.Request) {
 
 	id, ok := parseServiceID(r.URL.Path)
@@ -79,14 +140,15 @@ func (s *serviceHandler) putService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.containerService.Deploy(r.Context(), id); err != nil {
-		log.Printf("Fail to deploy service %s: %v\n", id, err)
-		handlers.WriteError(w, http.StatusInternalServerError,
-			errors.New("error deploying app"))
+	op, err := s.operationService.Deploy(id)
+	if err != nil {
+		log.Printf("Fail to queue deploy of service %s: %v\n", id, err)
+		handlers.WriteError(w, http.StatusServiceUnavailable, err)
 		return
 	}
 
-	handlers.WriteEntity(w, http.StatusOK, "service deployed")
+	w.Header().Set("Location", "/operations/"+op.ID)
+	handlers.WriteEntity(w, http.StatusAccepted, op)
 }
 
 func (s *serviceHandler) deleteService(w http.ResponseWriter, r *http.Request) {
@@ -98,14 +160,342 @@ func (s *serviceHandler) deleteService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.containerService.Undeploy(r.Context(), id); err != nil {
+	result, err := s.containerService.Undeploy(r.Context(), id)
+	if err != nil {
 		log.Printf("Fail to undeploy service %s: %v\n", id, err)
 		handlers.WriteError(w, http.StatusInternalServerError,
 			errors.New("fail to undeploying service"))
 		return
 	}
 
-	handlers.WriteEntity(w, http.StatusOK, "service undeployed")
+	handlers.WriteEntity(w, http.StatusOK, result)
+}
+
+func (s *serviceHandler) postRollback(w http.ResponseWriter, r *http.Request, id string) {
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	op, err := s.operationService.Rollback(id)
+	if err != nil {
+		log.Printf("Fail to queue rollback of service %s: %v\n", id, err)
+		handlers.WriteError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	w.Header().Set("Location", "/operations/"+op.ID)
+	handlers.WriteEntity(w, http.StatusAccepted, op)
+}
+
+// getDeployProgress streams the latest deploy or rollback of a service as
+// server-sent events, one progress event per change and a done event once
+// it finishes
+func (s *serviceHandler) getDeployProgress(w http.ResponseWriter, r *http.Request, id string) {
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	op, ok := s.operationService.Latest(id)
+	if !ok {
+		handlers.WriteError(w, http.StatusNotFound, errors.New("no deploy of service"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	stream := &streamWriter{w: w, contentType: "text/event-stream"}
+
+	for update := range s.operationService.Updates(r.Context(), op.ID) {
+		event := "progress"
+		if update.FinishedAt != nil {
+			event = "done"
+		}
+
+		data, err := json.Marshal(update)
+		if err != nil {
+			log.Printf("Fail to encode operation %s: %v\n", update.ID, err)
+			return
+		}
+
+		if _, err := fmt.Fprintf(stream, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return
+		}
+		stream.Flush()
+	}
+}
+
+// postControl pauses, resumes, restarts or signals the task of a service,
+// answering with its resulting info
+func (s *serviceHandler) postControl(w http.ResponseWriter, r *http.Request, id, action string) {
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var info *Info
+	var err error
+	switch action {
+	case "pause":
+		info, err = s.containerService.Pause(r.Context(), id)
+	case "resume":
+		info, err = s.containerService.Resume(r.Context(), id)
+	case "restart":
+		info, err = s.containerService.Restart(r.Context(), id)
+	case "signal":
+		sig, parseErr := parseSignal(r.URL.Query().Get("sig"))
+		if parseErr != nil {
+			handlers.WriteError(w, http.StatusBadRequest, parseErr)
+			return
+		}
+		info, err = s.containerService.Signal(r.Context(), id, sig)
+	}
+
+	switch {
+	case err == nil:
+		handlers.WriteEntity(w, http.StatusOK, info)
+	case errdefs.IsNotFound(err):
+		handlers.WriteError(w, http.StatusNotFound, errors.New("service is not deployed"))
+	case errors.Is(err, errNotRunning), errors.Is(err, errNotPaused):
+		handlers.WriteError(w, http.StatusConflict, err)
+	default:
+		log.Printf("Fail to %s service %s: %v\n", action, id, err)
+		handlers.WriteError(w, http.StatusInternalServerError,
+			fmt.Errorf("fail to %s service", action))
+	}
+}
+
+// postExec runs a process in a service over the hijacked connection. The
+// client sends raw stdin, half-closing the connection at its end, and
+// receives frames of an 8 byte header, holding the stream type and the
+// big endian payload size, followed by the payload: stdout and stderr as
+// they come and a last exit frame with the exit code or error as json.
+func (s *serviceHandler) postExec(w http.ResponseWriter, r *http.Request, id string) {
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the request is read whole, what follows it on the connection is stdin
+	switch {
+	case r.ContentLength < 0:
+		handlers.WriteError(w, http.StatusLengthRequired,
+			errors.New("exec request needs a content length"))
+		return
+	case r.ContentLength > maxExecRequestSize:
+		handlers.WriteError(w, http.StatusRequestEntityTooLarge,
+			errors.New("exec request is too large"))
+		return
+	}
+
+	body := make([]byte, r.ContentLength)
+	if _, err := io.ReadFull(r.Body, body); err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, errors.New("invalid exec request"))
+		return
+	}
+
+	var opts ExecOptions
+	if err := json.Unmarshal(body, &opts); err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, errors.New("invalid exec request"))
+		return
+	}
+
+	if len(opts.Args) == 0 {
+		handlers.WriteError(w, http.StatusBadRequest, errNoExecArgs)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		handlers.WriteError(w, http.StatusInternalServerError,
+			errors.New("connection does not support exec"))
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Fail to hijack exec connection of service %s: %v\n", id, err)
+		return
+	}
+	defer conn.Close()
+
+	status := "200 OK\r\nConnection: close"
+	if strings.EqualFold(r.Header.Get("Upgrade"), "tcp") {
+		status = "101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: tcp"
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 %s\r\nContent-Type: %s\r\n\r\n", status, execContentType)
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	// a hijacked request is not canceled when its client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mux := &execMux{w: rw.Writer, gone: cancel}
+
+	var stdin io.Reader
+	if opts.Stdin {
+		stdin = &execInput{r: rw.Reader, gone: cancel}
+	} else {
+		go watchClosed(rw.Reader, cancel)
+	}
+
+	stdout := mux.stream(execStdout)
+	stderr := mux.stream(execStderr)
+	if opts.TTY {
+		stderr = stdout
+	}
+
+	var exit execExit
+	code, err := s.containerService.Exec(ctx, id, opts, stdin, stdout, stderr)
+	if err != nil {
+		log.Printf("Fail to exec in service %s: %v\n", id, err)
+		exit.Error = err.Error()
+	} else {
+		exit.ExitCode = &code
+	}
+
+	data, err := json.Marshal(exit)
+	if err != nil {
+		return
+	}
+	mux.stream(execExitStream).Write(data)
+}
+
+func (s *serviceHandler) getLogs(w http.ResponseWriter, r *http.Request, id string) {
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := parseLogOptions(r.URL.Query())
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	stream := &streamWriter{w: w, contentType: "text/plain; charset=utf-8"}
+	if err := s.containerService.Logs(r.Context(), id, opts, stream); err != nil {
+		log.Printf("Fail to read logs of service %s: %v\n", id, err)
+		switch {
+		case stream.started:
+		case errors.Is(err, os.ErrNotExist):
+			handlers.WriteError(w, http.StatusNotFound, fmt.Errorf("no logs for service %s", id))
+		default:
+			handlers.WriteError(w, http.StatusInternalServerError,
+				errors.New("fail to read logs"))
+		}
+		return
+	}
+
+	stream.start()
+}
+
+func parseLogOptions(query url.Values) (LogOptions, error) {
+	var opts LogOptions
+
+	if tail := query.Get("tail"); tail != "" {
+		n, err := strconv.Atoi(tail)
+		if err != nil || n < 0 {
+			return opts, errors.New("tail must be a positive number")
+		}
+		opts.Tail = n
+	}
+
+	if since := query.Get("since"); since != "" {
+		t, err := ParseSince(since)
+		if err != nil {
+			return opts, err
+		}
+		opts.Since = t
+	}
+
+	opts.Follow = query.Get("follow") == "true"
+
+	return opts, nil
+}
+
+// streamWriter sends the response header on the first write, so a handler
+// can still answer with an error while nothing was streamed
+type streamWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	started     bool
+}
+
+func (sw *streamWriter) start() {
+	if sw.started {
+		return
+	}
+
+	sw.started = true
+	sw.w.Header().Set("Content-Type", sw.contentType)
+	sw.w.WriteHeader(http.StatusOK)
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.start()
+	return sw.w.Write(p)
+}
+
+func (sw *streamWriter) Flush() {
+	sw.start()
+	if flusher, ok := sw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type operationHandler struct {
+	operationService OperationService
+}
+
+func newOperationHandler(operationService OperationService) http.Handler {
+	return &operationHandler{operationService}
+}
+
+func (s *operationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, GET")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		s.getOperation(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *operationHandler) getOperation(w http.ResponseWriter, r *http.Request) {
+
+	id := strings.TrimPrefix(r.URL.Path, "/operations/")
+	if len(id) == 0 || strings.ContainsRune(id, '/') {
+		handlers.WriteError(w, http.StatusBadRequest, errors.New("invalid operation id"))
+		return
+	}
+
+	op, ok := s.operationService.Get(id)
+	if !ok {
+		handlers.WriteError(w, http.StatusNotFound, errors.New("operation not found"))
+		return
+	}
+
+	handlers.WriteEntity(w, http.StatusOK, op)
+}
+
+func parseServiceAction(path string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/service/"), "/", 2)
+
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
 }
 
 func parseServiceID(path string) (string, bool) {
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+// controlContainers records the control calls of the handler
+type controlContainers struct {
+	ContainerService
+	called string
+	signal syscall.Signal
+	err    error
+}
+
+func (c *controlContainers) control(action string) (*Info, error) {
+	c.called = action
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return &Info{}, nil
+}
+
+func (c *controlContainers) Pause(ctx context.Context, id string) (*Info, error) {
+	return c.control("pause")
+}
+
+func (c *controlContainers) Resume(ctx context.Context, id string) (*Info, error) {
+	return c.control("resume")
+}
+
+func (c *controlContainers) Restart(ctx context.Context, id string) (*Info, error) {
+	return c.control("restart")
+}
+
+func (c *controlContainers) Signal(ctx context.Context, id string, sig syscall.Signal) (*Info, error) {
+	c.signal = sig
+	return c.control("signal")
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		raw    string
+		signal syscall.Signal
+		ok     bool
+	}{
+		{"SIGTERM", syscall.SIGTERM, true},
+		{"sighup", syscall.SIGHUP, true},
+		{"USR1", syscall.SIGUSR1, true},
+		{"kill", syscall.SIGKILL, true},
+		{"15", syscall.SIGTERM, true},
+		{"0", 0, false},
+		{"-9", 0, false},
+		{"65", 0, false},
+		{"SIGNOPE", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		sig, err := parseSignal(test.raw)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: want ok %v got error %v\n", test.raw, test.ok, err)
+			continue
+		}
+
+		if sig != test.signal {
+			t.Errorf("%q: want signal %v got %v\n", test.raw, test.signal, sig)
+		}
+	}
+}
+
+func TestControlHandler(t *testing.T) {
+	notFound := fmt.Errorf("container helloweb not found: %w", errdefs.ErrNotFound)
+
+	tests := []struct {
+		method string
+		path   string
+		err    error
+		status int
+		called string
+		signal syscall.Signal
+	}{
+		{"POST", "/service/helloweb/pause", nil, http.StatusOK, "pause", 0},
+		{"POST", "/service/helloweb/resume", nil, http.StatusOK, "resume", 0},
+		{"POST", "/service/helloweb/restart", nil, http.StatusOK, "restart", 0},
+		{"POST", "/service/helloweb/signal?sig=SIGHUP", nil, http.StatusOK, "signal", syscall.SIGHUP},
+		{"POST", "/service/helloweb/signal?sig=usr1", nil, http.StatusOK, "signal", syscall.SIGUSR1},
+		{"POST", "/service/helloweb/signal?sig=9", nil, http.StatusOK, "signal", syscall.SIGKILL},
+		{"POST", "/service/helloweb/signal?sig=SIGNOPE", nil, http.StatusBadRequest, "", 0},
+		{"POST", "/service/helloweb/signal", nil, http.StatusBadRequest, "", 0},
+		{"GET", "/service/helloweb/pause", nil, http.StatusMethodNotAllowed, "", 0},
+		{"POST", "/service/helloweb/freeze", nil, http.StatusNotFound, "", 0},
+		{"POST", "/service/helloweb/pause", notFound, http.StatusNotFound, "pause", 0},
+		{"POST", "/service/helloweb/resume", errNotPaused, http.StatusConflict, "resume", 0},
+		{"POST", "/service/helloweb/pause", errNotRunning, http.StatusConflict, "pause", 0},
+		{"POST", "/service/helloweb/restart", fmt.Errorf("boom"), http.StatusInternalServerError, "restart", 0},
+	}
+
+	for _, test := range tests {
+		containers := &controlContainers{err: test.err}
+		handler := newServiceHandler(containers, nil)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: want status %d got %d\n", test.method, test.path, test.status, w.Code)
+		}
+
+		if containers.called != test.called {
+			t.Errorf("%s %s: want call %q got %q\n", test.method, test.path, test.called, containers.called)
+		}
+
+		if containers.signal != test.signal {
+			t.Errorf("%s %s: want signal %v got %v\n", test.method, test.path, test.signal, containers.signal)
+		}
+	}
+}
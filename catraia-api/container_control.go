@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+)
+
+// highest real-time signal on linux
+const maxSignal = syscall.Signal(64)
+
+var (
+	errNotRunning = errors.New("service is not running")
+	errNotPaused  = errors.New("service is not paused")
+)
+
+// Pause freezes the task of a service. The proxy turns its requests away
+// until it is resumed. Controls wait for any deploy of the service, so they
+// act on the task it leaves.
+func (c *service) Pause(ctx context.Context, id string) (*Info, error) {
+	defer c.locks.lock(id)()
+
+	err := c.withTask(ctx, id, func(ctx context.Context, task containerd.Task) error {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		if status.Status != containerd.Running {
+			return errNotRunning
+		}
+
+		log.Printf("Pausing service %s\n", id)
+		if err := task.Pause(ctx); err != nil {
+			return err
+		}
+
+		if err := c.router.Pause(id); err != nil {
+			log.Printf("Fail to pause endpoint of service %s: %v\n", id, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Info(ctx, id)
+}
+
+// Resume thaws the task of a paused service
+func (c *service) Resume(ctx context.Context, id string) (*Info, error) {
+	defer c.locks.lock(id)()
+
+	err := c.withTask(ctx, id, func(ctx context.Context, task containerd.Task) error {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		if status.Status != containerd.Paused {
+			return errNotPaused
+		}
+
+		log.Printf("Resuming service %s\n", id)
+		return c.resumeTask(ctx, id, task)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Info(ctx, id)
+}
+
+// Restart replaces the task of a service by a new one on the same
+// container, with a clean restart history
+func (c *service) Restart(ctx context.Context, id string) (*Info, error) {
+	defer c.locks.lock(id)()
+
+	err := c.withTask(ctx, id, func(ctx context.Context, task containerd.Task) error {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		// a frozen task does not handle the signal that stops it
+		if status.Status == containerd.Paused {
+			if err := c.resumeTask(ctx, id, task); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Restarting service %s\n", id)
+	c.supervisor.Unwatch(id)
+
+	containerID, pid, err := c.restartTask(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.supervisor.Watch(id, containerID, pid)
+
+	return c.Info(ctx, id)
+}
+
+// Signal sends a signal to the task of a service. A signal that ends it is
+// handled by the restart policy as any other exit.
+func (c *service) Signal(ctx context.Context, id string, sig syscall.Signal) (*Info, error) {
+	defer c.locks.lock(id)()
+
+	err := c.withTask(ctx, id, func(ctx context.Context, task containerd.Task) error {
+		log.Printf("Sending signal %d to service %s\n", sig, id)
+		return task.Kill(ctx, sig)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Info(ctx, id)
+}
+
+// parseSignal takes a signal by number or by name, with or without the SIG
+// prefix and in any case
+func parseSignal(raw string) (syscall.Signal, error) {
+	name := strings.ToUpper(raw)
+	if _, err := strconv.Atoi(name); err != nil && !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	sig, err := containerd.ParseSignal(name)
+	if err != nil || sig <= 0 || sig > maxSignal {
+		return 0, fmt.Errorf("unknown signal %q", raw)
+	}
+
+	return sig, nil
+}
+
+func (c *service) resumeTask(ctx context.Context, id string, task containerd.Task) error {
+	if err := task.Resume(ctx); err != nil {
+		return err
+	}
+
+	if err := c.router.Resume(id); err != nil {
+		log.Printf("Fail to resume endpoint of service %s: %v\n", id, err)
+	}
+
+	return nil
+}
+
+// withTask calls fn with the task of the active container of a service
+func (c *service) withTask(ctx context.Context, id string,
+	fn func(context.Context, containerd.Task) error) error {
+
+	log.Printf("Conneting to containerd\n")
+	client, err := containerd.New(c.conf.Socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, c.conf.Namespace)
+	container, err := loadActiveContainer(ctx, client, id)
+	if err != nil {
+		return fmt.Errorf("container %s not found: %w", id, err)
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("task of %s not found: %w", id, err)
+	}
+
+	return fn(ctx, task)
+}
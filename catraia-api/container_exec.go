@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/google/uuid"
+)
+
+var errNoExecArgs = errors.New("exec args must not be empty")
+
+// ExecOptions describes a process to run in the task of a service. Env is
+// added to the environment of the service, Stdin tells whether the client
+// sends input and Width and Height size the terminal when TTY is set.
+type ExecOptions struct {
+	Args   []string `json:"args"`
+	Env    []string `json:"env"`
+	Cwd    string   `json:"cwd"`
+	Stdin  bool     `json:"stdin"`
+	TTY    bool     `json:"tty"`
+	Width  uint32   `json:"width"`
+	Height uint32   `json:"height"`
+}
+
+// Exec runs a process in the running task of a service, wired to the given
+// streams, and returns its exit code. Stdout gets stderr too with a TTY.
+// The process is killed when ctx is done.
+func (c *service) Exec(ctx context.Context, id string, opts ExecOptions,
+	stdin io.Reader, stdout, stderr io.Writer) (uint32, error) {
+
+	if len(opts.Args) == 0 {
+		return 0, errNoExecArgs
+	}
+
+	log.Printf("Conneting to containerd\n")
+	client, err := containerd.New(c.conf.Socket)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, c.conf.Namespace)
+	container, err := loadActiveContainer(ctx, client, id)
+	if err != nil {
+		return 0, fmt.Errorf("container %s not found: %w", id, err)
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	pspec := *spec.Process
+	pspec.Args = opts.Args
+	pspec.Env = append(append([]string{}, spec.Process.Env...), opts.Env...)
+	pspec.Terminal = opts.TTY
+	if opts.Cwd != "" {
+		pspec.Cwd = opts.Cwd
+	}
+
+	ioOpts := []cio.Opt{cio.WithStreams(stdin, stdout, stderr)}
+	if opts.TTY {
+		ioOpts = append(ioOpts, cio.WithTerminal)
+	}
+
+	// the process outlives ctx long enough to be killed and deleted
+	bg := namespaces.WithNamespace(context.Background(), c.conf.Namespace)
+
+	execID := "exec-" + uuid.New().String()
+	log.Printf("Executing %v in container %s as %s\n", opts.Args, container.ID(), execID)
+	process, err := task.Exec(ctx, execID, &pspec, cio.NewCreator(ioOpts...))
+	if err != nil {
+		return 0, err
+	}
+	defer process.Delete(bg, containerd.WithProcessKill)
+
+	exitCh, err := process.Wait(bg)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := process.Start(ctx); err != nil {
+		return 0, err
+	}
+
+	if opts.TTY && opts.Width > 0 && opts.Height > 0 {
+		if err := process.Resize(ctx, opts.Width, opts.Height); err != nil {
+			log.Printf("Fail to resize terminal of %s: %v\n", execID, err)
+		}
+	}
+
+	var status containerd.ExitStatus
+	select {
+	case status = <-exitCh:
+	case <-ctx.Done():
+		log.Printf("Killing %s, its client is gone\n", execID)
+		if err := process.Kill(bg, syscall.SIGKILL); err != nil {
+			log.Printf("Fail to kill %s: %v\n", execID, err)
+		}
+		status = <-exitCh
+	}
+
+	// flush the output before reporting the exit
+	process.IO().Wait()
+
+	code, _, err := status.Result()
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Process %s exited with %d\n", execID, code)
+	return code, nil
+}
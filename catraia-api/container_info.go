@@ -6,15 +6,96 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/opencontainers/go-digest"
+)
+
+// Readiness check defaults
+const (
+	defaultReadinessPath    = "/"
+	defaultReadinessTimeout = 30
+)
+
+// Restart policies
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
 )
 
+type RestartPolicy struct {
+	Policy     string `json:"policy"`
+	MaxRetries int    `json:"max_retries"`
+}
+
+// ReadinessCheck tells when a new container may receive traffic: once a
+// GET to Path answers without a server error, within Timeout seconds
+type ReadinessCheck struct {
+	Path    string `json:"path"`
+	Timeout int    `json:"timeout"`
+}
+
+// Mount makes a named volume or a host directory, Source, available to a
+// service at Target
+type Mount struct {
+	Volume   string `json:"volume,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// SecretRef gives a secret to a service as a read-only file at File or as
+// the environment variable Env
+type SecretRef struct {
+	Name string `json:"name"`
+	File string `json:"file,omitempty"`
+	Env  string `json:"env,omitempty"`
+}
+
+// ImageInfo describes how to run a service. Entrypoint, Cmd, Env,
+// WorkingDir, Hostname and Ulimits override the process of the image and
+// Labels are set on its containers. Digest pins the image Ref must resolve
+// to and PublicKey, the path of a PEM encoded ed25519 or ECDSA key,
+// requires the image to carry a cosign signature made with it.
+// StopSignal, by default the one of the image, is sent to stop the task,
+// which is killed if still running after StopTimeout seconds. Security
+// restricts the service, a profile being applied even when not given.
+// UserNamespace runs the service with its ids remapped to a range of
+// subordinate ids of the host. Desired, running or stopped, is the state
+// the reconciler keeps the service in, Autostart being short for running.
 type ImageInfo struct {
-	ID  string `json:"-"`
-	Ref string `json:ref`
+	ID          string            `json:"-"`
+	Ref         string            `json:"ref"`
+	Desired     string            `json:"desired,omitempty"`
+	Autostart   bool              `json:"autostart,omitempty"`
+	Entrypoint  []string          `json:"entrypoint,omitempty"`
+	Cmd         []string          `json:"cmd,omitempty"`
+	Env         []EnvVar          `json:"env,omitempty"`
+	WorkingDir  string            `json:"working_dir,omitempty"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Ulimits     []Ulimit          `json:"ulimits,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	PublicKey   string            `json:"public_key,omitempty"`
+	Restart     RestartPolicy     `json:"restart"`
+	Readiness   ReadinessCheck    `json:"readiness"`
+	StopSignal  string            `json:"stop_signal,omitempty"`
+	StopTimeout int               `json:"stop_timeout"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Secrets     []SecretRef       `json:"secrets,omitempty"`
+	Resources   Resources         `json:"resources"`
+	Security    SecurityProfile   `json:"security"`
+
+	UserNamespace bool `json:"user_namespace,omitempty"`
 }
 
 type ImageInfoService interface {
 	Get(id string) (*ImageInfo, error)
+	List() ([]*ImageInfo, error)
 }
 
 type infoMap map[string]*ImageInfo
@@ -56,6 +137,10 @@ func parseInfoData(reader io.Reader) (infoMap, error) {
 		}
 
 		info.ID = id
+		if err := info.validate(); err != nil {
+			return nil, parseError(fmt.Errorf("service %s: %v", id, err))
+		}
+
 		data[id] = &info
 	}
 
@@ -68,6 +153,120 @@ func parseInfoData(reader io.Reader) (infoMap, error) {
 
 }
 
+func (info *ImageInfo) validate() error {
+	switch info.Restart.Policy {
+	case "":
+		info.Restart.Policy = RestartNo
+	case RestartNo, RestartOnFailure, RestartAlways:
+	default:
+		return fmt.Errorf("unknown restart policy %q", info.Restart.Policy)
+	}
+
+	if info.Restart.MaxRetries < 0 {
+		return errors.New("restart max_retries must not be negative")
+	}
+
+	switch info.Desired {
+	case "":
+		if info.Autostart {
+			info.Desired = DesiredRunning
+		}
+	case DesiredRunning:
+	case DesiredStopped:
+		if info.Autostart {
+			return errors.New("autostart service can not be desired stopped")
+		}
+	default:
+		return fmt.Errorf("unknown desired state %q", info.Desired)
+	}
+
+	if err := info.validateProcess(); err != nil {
+		return err
+	}
+
+	if info.Digest != "" {
+		if _, err := digest.Parse(info.Digest); err != nil {
+			return fmt.Errorf("invalid digest %q: %v", info.Digest, err)
+		}
+	}
+
+	if info.Readiness.Path == "" {
+		info.Readiness.Path = defaultReadinessPath
+	}
+
+	switch {
+	case info.Readiness.Timeout == 0:
+		info.Readiness.Timeout = defaultReadinessTimeout
+	case info.Readiness.Timeout < 0:
+		return errors.New("readiness timeout must not be negative")
+	}
+
+	if info.StopSignal != "" {
+		if _, err := containerd.ParseSignal(info.StopSignal); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case info.StopTimeout == 0:
+		info.StopTimeout = defaultStopTimeout
+	case info.StopTimeout < 0:
+		return errors.New("stop timeout must not be negative")
+	}
+
+	for _, m := range info.Mounts {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, ref := range info.Secrets {
+		if err := ref.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := info.Resources.validate(); err != nil {
+		return err
+	}
+
+	if err := info.Security.validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ref *SecretRef) validate() error {
+	switch {
+	case !secretNamePattern.MatchString(ref.Name):
+		return fmt.Errorf("invalid secret name %q", ref.Name)
+	case (ref.File == "") == (ref.Env == ""):
+		return fmt.Errorf("secret %s needs either file or env", ref.Name)
+	case ref.File != "" && !filepath.IsAbs(ref.File):
+		return fmt.Errorf("secret file %q must be an absolute path", ref.File)
+	case strings.ContainsRune(ref.Env, '='):
+		return fmt.Errorf("invalid secret env %q", ref.Env)
+	}
+
+	return nil
+}
+
+func (m *Mount) validate() error {
+	switch {
+	case m.Volume != "" && m.Source != "":
+		return fmt.Errorf("mount of %s has both volume and source", m.Target)
+	case m.Volume != "" && !volumeNamePattern.MatchString(m.Volume):
+		return fmt.Errorf("invalid volume name %q", m.Volume)
+	case m.Volume == "" && !filepath.IsAbs(m.Source):
+		return fmt.Errorf("mount source %q must be an absolute path", m.Source)
+	case !filepath.IsAbs(m.Target):
+		return fmt.Errorf("mount target %q must be an absolute path", m.Target)
+	}
+
+	return nil
+}
+
 func parseError(err error) error {
 	return fmt.Errorf("invalid info data: %v", err)
 }
@@ -75,3 +274,16 @@ func parseError(err error) error {
 func (cMap infoMap) Get(id string) (*ImageInfo, error) {
 	return cMap[id], nil
 }
+
+func (cMap infoMap) List() ([]*ImageInfo, error) {
+	infos := make([]*ImageInfo, 0, len(cMap))
+	for _, info := range cMap {
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 	"strings"
 )
@@ -21,10 +22,16 @@ func TestParseInfo(t *testing.T) {
 		"helloweb": &ImageInfo{
 			ID: "helloweb",
 			Ref: "docker.io/renatofq/helloweb:latest",
+			Restart: RestartPolicy{Policy: RestartNo},
+			Readiness: ReadinessCheck{Path: "/", Timeout: 30},
+			StopTimeout: defaultStopTimeout,
 		},
 		"helloworld": &ImageInfo{
 			ID: "helloworld",
 			Ref: "docker.io/renatofq/helloworld:latest",
+			Restart: RestartPolicy{Policy: RestartNo},
+			Readiness: ReadinessCheck{Path: "/", Timeout: 30},
+			StopTimeout: defaultStopTimeout,
 		},
 	}
 
@@ -34,9 +41,165 @@ func TestParseInfo(t *testing.T) {
 	}
 
 	for k, v := range expected {
-		if *result[k] != *v {
-			t.Errorf("at %s want %q got %q\n", k, v, result[k])
+		if !reflect.DeepEqual(result[k], v) {
+			t.Errorf("at %s want %v got %v\n", k, v, result[k])
 		}
 	}
 
 }
+
+func TestListInfo(t *testing.T) {
+	jsonData := `
+        {
+          "helloworld" : {
+            "ref" : "docker.io/renatofq/helloworld:latest"
+          },
+          "helloweb" : {
+            "ref" : "docker.io/renatofq/helloweb:latest"
+          }
+        }
+`
+
+	infos, err := parseInfoData(strings.NewReader(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := infos.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"helloweb", "helloworld"}
+	if len(result) != len(expected) {
+		t.Fatalf("want %d infos got %d\n", len(expected), len(result))
+	}
+
+	for i, id := range expected {
+		if result[i].ID != id {
+			t.Errorf("at %d want %s got %s\n", i, id, result[i].ID)
+		}
+	}
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	jsonData := `
+        {
+          "helloweb" : {
+            "ref" : "docker.io/renatofq/helloweb:latest",
+            "restart" : { "policy" : "on-failure", "max_retries" : 5 }
+          }
+        }
+`
+
+	result, err := parseInfoData(strings.NewReader(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := RestartPolicy{Policy: RestartOnFailure, MaxRetries: 5}
+	if result["helloweb"].Restart != expected {
+		t.Errorf("want %v got %v\n", expected, result["helloweb"].Restart)
+	}
+
+	invalidData := `{ "helloweb" : { "restart" : { "policy" : "sometimes" } } }`
+	if _, err := parseInfoData(strings.NewReader(invalidData)); err == nil {
+		t.Error("unknown restart policy accepted")
+	}
+}
+
+func TestParseReadiness(t *testing.T) {
+	jsonData := `
+        {
+          "helloweb" : {
+            "ref" : "docker.io/renatofq/helloweb:latest",
+            "readiness" : { "path" : "/health", "timeout" : 10 }
+          }
+        }
+`
+
+	result, err := parseInfoData(strings.NewReader(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ReadinessCheck{Path: "/health", Timeout: 10}
+	if result["helloweb"].Readiness != expected {
+		t.Errorf("want %v got %v\n", expected, result["helloweb"].Readiness)
+	}
+
+	invalidData := `{ "helloweb" : { "readiness" : { "timeout" : -1 } } }`
+	if _, err := parseInfoData(strings.NewReader(invalidData)); err == nil {
+		t.Error("negative readiness timeout accepted")
+	}
+}
+
+func TestParseStopSettings(t *testing.T) {
+	jsonData := `
+        {
+          "helloweb" : {
+            "ref" : "docker.io/renatofq/helloweb:latest",
+            "stop_signal" : "SIGQUIT",
+            "stop_timeout" : 3
+          }
+        }
+`
+
+	result, err := parseInfoData(strings.NewReader(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info := result["helloweb"]; info.StopSignal != "SIGQUIT" || info.StopTimeout != 3 {
+		t.Errorf("want SIGQUIT/3 got %s/%d\n", info.StopSignal, info.StopTimeout)
+	}
+
+	invalidData := `{ "helloweb" : { "stop_signal" : "SIGNOPE" } }`
+	if _, err := parseInfoData(strings.NewReader(invalidData)); err == nil {
+		t.Error("unknown stop signal accepted")
+	}
+
+	invalidData = `{ "helloweb" : { "stop_timeout" : -1 } }`
+	if _, err := parseInfoData(strings.NewReader(invalidData)); err == nil {
+		t.Error("negative stop timeout accepted")
+	}
+}
+
+func TestParseMounts(t *testing.T) {
+	jsonData := `
+        {
+          "helloweb" : {
+            "ref" : "docker.io/renatofq/helloweb:latest",
+            "mounts" : [
+              { "volume" : "data", "target" : "/data" },
+              { "source" : "/etc/ssl/certs", "target" : "/etc/ssl/certs", "read_only" : true }
+            ]
+          }
+        }
+`
+
+	result, err := parseInfoData(strings.NewReader(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Mount{
+		{Volume: "data", Target: "/data"},
+		{Source: "/etc/ssl/certs", Target: "/etc/ssl/certs", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(result["helloweb"].Mounts, expected) {
+		t.Errorf("want %v got %v\n", expected, result["helloweb"].Mounts)
+	}
+
+	invalid := []string{
+		`{ "helloweb" : { "mounts" : [ { "volume" : "data", "source" : "/data", "target" : "/data" } ] } }`,
+		`{ "helloweb" : { "mounts" : [ { "volume" : "../etc", "target" : "/data" } ] } }`,
+		`{ "helloweb" : { "mounts" : [ { "source" : "data", "target" : "/data" } ] } }`,
+		`{ "helloweb" : { "mounts" : [ { "volume" : "data", "target" : "data" } ] } }`,
+	}
+	for _, data := range invalid {
+		if _, err := parseInfoData(strings.NewReader(data)); err == nil {
+			t.Errorf("invalid mount accepted: %s\n", data)
+		}
+	}
+}
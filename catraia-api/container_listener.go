@@ -4,27 +4,47 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/renatofq/catraia/events"
 	"github.com/renatofq/catraia/handlers"
 	"github.com/renatofq/catraia/utils"
 )
 
+// NetListener notifies catraia-net about container events and queries the
+// endpoints it assigns
+type NetListener interface {
+	CreationListener
+	EndpointRouter
+	Metrics(ctx context.Context, w io.Writer) error
+}
+
 type containerListener struct {
 	client http.Client
+
+	// reaches containers through the proxy of catraia-net, which shares
+	// their network
+	proxyClient http.Client
 }
 
-func NewContainerListener(address string) CreationListener {
+func NewContainerListener(address, proxyAddress string) NetListener {
 	return &containerListener{
-		client: http.Client{
-			Transport: &http.Transport{
-				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-					return net.Dial(utils.NetTypeFromAddr(address), address)
-				},
+		client:      unixClient(address),
+		proxyClient: unixClient(proxyAddress),
+	}
+}
+
+func unixClient(address string) http.Client {
+	return http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial(utils.NetTypeFromAddr(address), address)
 			},
 		},
 	}
@@ -38,31 +58,138 @@ func (cl *containerListener) Created(id string, pid uint32) {
 		Namespace: getNetns(pid),
 	}
 
+	if err := cl.notify(event); err != nil {
+		log.Printf("Fail to notify container creation: %v\n", err)
+	}
+}
+
+// Route makes the proxy send the traffic of a service to a container
+func (cl *containerListener) Route(id, containerID string) error {
+	return cl.notify(events.ContainerEvent{
+		Type:    events.ContainerRouted,
+		ID:      containerID,
+		Service: id,
+	})
+}
+
+// Pause makes the proxy refuse the requests to a service
+func (cl *containerListener) Pause(id string) error {
+	return cl.notify(events.ContainerEvent{
+		Type: events.ServicePaused,
+		ID:   id,
+	})
+}
+
+// Resume lets the proxy send requests to a service again
+func (cl *containerListener) Resume(id string) error {
+	return cl.notify(events.ContainerEvent{
+		Type: events.ServiceResumed,
+		ID:   id,
+	})
+}
+
+// Unroute drops the endpoint of a container or service
+func (cl *containerListener) Unroute(id string) error {
+	return cl.notify(events.ContainerEvent{
+		Type: events.ContainerRemoved,
+		ID:   id,
+	})
+}
+
+func (cl *containerListener) notify(event events.ContainerEvent) error {
+
 	data, err := json.Marshal(event)
 	if err != nil {
-		log.Printf("Fail to generate json for event %v: %v\n", event, err)
-		return
+		return fmt.Errorf("fail to generate json for event %v: %v", event, err)
 	}
 
 	resp, err := cl.client.Post("http://unix/container", "application/json",
 		bytes.NewReader(data))
 	if err != nil {
-		log.Printf("Event server returned error for event %s: %v\n", data, err)
-		return
+		return fmt.Errorf("event server returned error for event %s: %v", data, err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		errResp, err := handlers.ReadError(resp)
 		if err != nil {
-			log.Printf("ErrorResponse from EventServer is invalid: %v\n", err)
-			return
+			return fmt.Errorf("event %s failed with status %s", event.Type, resp.Status)
 		}
 
-		log.Printf("Fail to notify container creation. status %s: %s\n",
-			resp.Status, errResp.Message)
+		return fmt.Errorf("event %s failed with status %s: %s",
+			event.Type, resp.Status, errResp.Message)
+	}
+
+	return nil
+}
+
+// Probe requests path from a container through the proxy. Any answer but
+// a server error means the container is ready.
+func (cl *containerListener) Probe(ctx context.Context, containerID, path string) error {
+	req, err := http.NewRequest(http.MethodGet,
+		"http://unix/"+containerID+"/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cl.proxyClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("readiness check answered %s", resp.Status)
 	}
+
+	return nil
 }
 
 func getNetns(pid uint32) string {
 	return fmt.Sprintf("/proc/%d/ns/net", pid)
 }
+
+func (cl *containerListener) Endpoint(id string) (string, error) {
+	resp, err := cl.client.Get("http://unix/endpoint/" + id)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp, err := handlers.ReadError(resp)
+		if err != nil {
+			return "", fmt.Errorf("endpoint query failed with status %s", resp.Status)
+		}
+
+		return "", errors.New(errResp.Message)
+	}
+
+	var endpoint events.Endpoint
+	if err := json.NewDecoder(resp.Body).Decode(&endpoint); err != nil {
+		return "", err
+	}
+
+	return endpoint.URL, nil
+}
+
+// Metrics copies the metrics exported by catraia-net to w
+func (cl *containerListener) Metrics(ctx context.Context, w io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, "http://unix/metrics", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cl.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metrics query failed with status %s", resp.Status)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
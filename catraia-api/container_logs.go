@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/cio"
+)
+
+// interval between reads of a log file being followed
+const followInterval = 500 * time.Millisecond
+
+// longest line held for its end, so a task writing no newline can not take
+// the memory of catraia
+const maxPendingLine = 16 * 1024
+
+type LogOptions struct {
+	Tail   int
+	Since  time.Time
+	Follow bool
+}
+
+// logStore keeps the output of each service task in a set of size rotated
+// files. Every line is prefixed by its timestamp and stream name.
+type logStore struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	mutex sync.Mutex
+	files map[string]*rotatingFile
+}
+
+func newLogStore(dir string, maxSize int64, maxFiles int) *logStore {
+	return &logStore{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		files:    make(map[string]*rotatingFile),
+	}
+}
+
+// Creator returns the IO creator of a new task of the service id
+func (ls *logStore) Creator(id string) (cio.Creator, error) {
+	file, err := ls.open(id)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := &lineWriter{file: file, stream: "stdout"}
+	stderr := &lineWriter{file: file, stream: "stderr"}
+
+	creator := cio.NewCreator(cio.WithStreams(nil, stdout, stderr))
+	return func(id string) (cio.IO, error) {
+		taskIO, err := creator(id)
+		if err != nil {
+			return nil, err
+		}
+
+		return &flushingIO{IO: taskIO, writers: []*lineWriter{stdout, stderr}}, nil
+	}, nil
+}
+
+// flushingIO writes the last incomplete lines of a task when its IO is
+// closed, which its deletion does once the streams are copied
+type flushingIO struct {
+	cio.IO
+	writers []*lineWriter
+}
+
+func (f *flushingIO) Close() error {
+	err := f.IO.Close()
+
+	for _, w := range f.writers {
+		if flushErr := w.Flush(); flushErr != nil {
+			log.Printf("Fail to flush %s log: %v\n", w.stream, flushErr)
+		}
+	}
+
+	return err
+}
+
+// Close releases the log file of a service. Its content is kept.
+func (ls *logStore) Close(id string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	file, ok := ls.files[id]
+	if !ok {
+		return nil
+	}
+
+	delete(ls.files, id)
+	return file.Close()
+}
+
+func (ls *logStore) open(id string) (*rotatingFile, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if file, ok := ls.files[id]; ok {
+		return file, nil
+	}
+
+	if err := os.MkdirAll(ls.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := openRotatingFile(ls.path(id), ls.maxSize, ls.maxFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	ls.files[id] = file
+	return file, nil
+}
+
+func (ls *logStore) path(id string) string {
+	return filepath.Join(ls.dir, id+".log")
+}
+
+// Write copies the log lines of service id selected by opts to w. When
+// following, it returns only when ctx is done.
+func (ls *logStore) Write(ctx context.Context, id string, opts LogOptions, w io.Writer) error {
+	path := ls.path(id)
+
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no logs for service %s: %w", id, err)
+	}
+
+	lines, err := ls.readLines(path, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+
+	if !opts.Follow {
+		return nil
+	}
+
+	return follow(ctx, path, opts.Since, w)
+}
+
+// readLines returns the lines of all rotated files from the oldest to the
+// newest, keeping only the last opts.Tail ones when it is positive
+func (ls *logStore) readLines(path string, opts LogOptions) ([]string, error) {
+	var lines []string
+
+	for i := ls.maxFiles - 1; i >= 0; i-- {
+		file, err := os.Open(rotatedPath(path, i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadString('\n')
+			if len(line) > 0 && lineAfter(line, opts.Since) {
+				lines = append(lines, line)
+				if opts.Tail > 0 && len(lines) > opts.Tail {
+					lines = lines[1:]
+				}
+			}
+
+			if err != nil {
+				break
+			}
+		}
+
+		file.Close()
+	}
+
+	return lines, nil
+}
+
+// follow streams lines appended to path after its current end, reopening
+// it when rotated
+func follow(ctx context.Context, path string, since time.Time, w io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	flusher, _ := w.(interface{ Flush() })
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == nil {
+			if lineAfter(line, since) {
+				if _, err := io.WriteString(w, line); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if err != io.EOF {
+			return err
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(followInterval):
+		}
+
+		if rotated(file, path) {
+			if newFile, err := os.Open(path); err == nil {
+				if err := drain(reader, line, since, w); err != nil {
+					newFile.Close()
+					return err
+				}
+
+				file.Close()
+				file = newFile
+				reader = bufio.NewReader(file)
+				continue
+			}
+		}
+
+		if len(line) > 0 {
+			// partial line, read it again once it is complete
+			if _, err := file.Seek(-int64(len(line)), io.SeekCurrent); err != nil {
+				return err
+			}
+			reader.Reset(file)
+		}
+	}
+}
+
+// drain sends what is left of a rotated file after a partial line already
+// read. Its last line is ended, as it will not be completed anymore.
+func drain(reader *bufio.Reader, partial string, since time.Time, w io.Writer) error {
+	for {
+		rest, err := reader.ReadString('\n')
+		line := partial + rest
+		partial = ""
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if err == io.EOF {
+			if line == "" {
+				return nil
+			}
+			line += "\n"
+		}
+
+		if lineAfter(line, since) {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func rotated(file *os.File, path string) bool {
+	current, err := file.Stat()
+	if err != nil {
+		return true
+	}
+
+	latest, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	return !os.SameFile(current, latest)
+}
+
+func lineAfter(line string, since time.Time) bool {
+	if since.IsZero() {
+		return true
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return true
+	}
+
+	return !timestamp.Before(since)
+}
+
+// ParseSince accepts either a RFC 3339 timestamp or a duration relative to
+// now, as in "10m"
+func ParseSince(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, errors.New("since must be a timestamp or a duration")
+	}
+
+	return time.Now().Add(-d), nil
+}
+
+// lineWriter prefixes each line written by a task stream before writing it
+// to the log file. Incomplete lines are held until their end is received or
+// they reach maxPendingLine, when they are written as a line of their own.
+type lineWriter struct {
+	file    *rotatingFile
+	stream  string
+	mutex   sync.Mutex
+	pending []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	data := append(lw.pending, p...)
+
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+
+		if err := lw.writeLine(data[:i+1]); err != nil {
+			return 0, err
+		}
+
+		data = data[i+1:]
+	}
+
+	for len(data) >= maxPendingLine {
+		line := append(append([]byte(nil), data[:maxPendingLine]...), '\n')
+		if err := lw.writeLine(line); err != nil {
+			return 0, err
+		}
+
+		data = data[maxPendingLine:]
+	}
+
+	lw.pending = append([]byte(nil), data...)
+
+	return len(p), nil
+}
+
+// Flush writes the incomplete line held, if any
+func (lw *lineWriter) Flush() error {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	if len(lw.pending) == 0 {
+		return nil
+	}
+
+	line := append(lw.pending, '\n')
+	lw.pending = nil
+
+	return lw.writeLine(line)
+}
+
+func (lw *lineWriter) writeLine(line []byte) error {
+	prefix := time.Now().UTC().Format(time.RFC3339Nano) + " " + lw.stream + " "
+
+	_, err := lw.file.Write(append([]byte(prefix), line...))
+	return err
+}
+
+// rotatingFile is a file renamed with a numeric suffix when it reaches
+// maxSize. Only maxFiles files are kept, including the current one.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+
+	err := rf.file.Close()
+	rf.file = nil
+
+	return err
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	if rf.maxFiles > 1 {
+		for i := rf.maxFiles - 2; i >= 0; i-- {
+			err := os.Rename(rotatedPath(rf.path, i), rotatedPath(rf.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	} else if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return rf.open()
+}
+
+func rotatedPath(path string, index int) string {
+	if index == 0 {
+		return path
+	}
+
+	return fmt.Sprintf("%s.%d", path, index)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/cio"
+)
+
+func TestLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logs := newLogStore(dir, 64, 2)
+	file, err := logs.open("helloweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &lineWriter{file: file, stream: "stdout"}
+	for _, line := range []string{"first\n", "second\n", "thi", "rd\n", "fourth\n"} {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "helloweb.log.2")); !os.IsNotExist(err) {
+		t.Errorf("want at most 2 log files, got a third one\n")
+	}
+
+	lines, err := logs.readLines(logs.path("helloweb"), LogOptions{Tail: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"third\n", "fourth\n"}
+	if len(lines) != len(expected) {
+		t.Fatalf("want %d lines got %d: %q\n", len(expected), len(lines), lines)
+	}
+
+	for i, line := range lines {
+		if len(line) < len(expected[i]) || line[len(line)-len(expected[i]):] != expected[i] {
+			t.Errorf("at %d want line ending with %q got %q\n", i, expected[i], line)
+		}
+	}
+}
+
+func TestFollowRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "helloweb.log")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() { done <- follow(ctx, path, time.Time{}, &out) }()
+
+	time.Sleep(followInterval / 5)
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("first\nparti")
+	file.Close()
+
+	time.Sleep(followInterval / 2)
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("second\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * followInterval)
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "first\nparti\nsecond\n"
+	if out.String() != expected {
+		t.Errorf("want %q got %q\n", expected, out.String())
+	}
+}
+
+func TestLongAndLastLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logs := newLogStore(dir, 1<<20, 2)
+	file, err := logs.open("helloweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &lineWriter{file: file, stream: "stdout"}
+	long := bytes.Repeat([]byte("x"), maxPendingLine+10)
+	if _, err := writer.Write(long); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(writer.pending) != 10 {
+		t.Errorf("want 10 bytes held got %d\n", len(writer.pending))
+	}
+
+	if _, err := writer.Write([]byte("\nlast")); err != nil {
+		t.Fatal(err)
+	}
+
+	taskIO := &flushingIO{IO: closedIO{}, writers: []*lineWriter{writer}}
+	if err := taskIO.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := logs.readLines(logs.path("helloweb"), LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{maxPendingLine, 10, 4}
+	if len(lines) != len(expected) {
+		t.Fatalf("want %d lines got %d\n", len(expected), len(lines))
+	}
+
+	for i, line := range lines {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		if len(fields) != 3 || len(fields[2]) != expected[i] {
+			t.Errorf("at %d want a line of %d bytes got %q\n", i, expected[i], line)
+		}
+	}
+
+	if !strings.HasSuffix(lines[2], " last\n") {
+		t.Errorf("want last partial line flushed got %q\n", lines[2])
+	}
+}
+
+type closedIO struct {
+	cio.IO
+}
+
+func (closedIO) Close() error {
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/containerd/cgroups/stats/v1"
+	v2 "github.com/containerd/cgroups/v2/stats"
+	"github.com/containerd/typeurl"
+	"github.com/gogo/protobuf/types"
+)
+
+// clock ticks per second used by the kernel in /proc/<pid>/stat
+const userHZ = 100
+
+// ContainerMetrics is the resource usage of a task, with the same shape
+// whether the host runs cgroup v1 or v2. Times are in nanoseconds and sizes
+// in bytes. A limit of zero means no limit was read.
+type ContainerMetrics struct {
+	CPU     CPUMetrics     `json:"cpu"`
+	Memory  MemoryMetrics  `json:"memory"`
+	Pids    PidsMetrics    `json:"pids"`
+	BlockIO BlockIOMetrics `json:"block_io"`
+}
+
+type CPUMetrics struct {
+	// total CPU time consumed, user plus system
+	UsageNanos  uint64 `json:"usage_ns"`
+	UserNanos   uint64 `json:"user_ns"`
+	SystemNanos uint64 `json:"system_ns"`
+
+	// CFS enforcement periods elapsed, those in which the task was
+	// throttled and the total time it was throttled for
+	Periods          uint64 `json:"periods"`
+	ThrottledPeriods uint64 `json:"throttled_periods"`
+	ThrottledNanos   uint64 `json:"throttled_ns"`
+}
+
+type MemoryMetrics struct {
+	UsageBytes     uint64 `json:"usage_bytes"`
+	LimitBytes     uint64 `json:"limit_bytes"`
+	SwapUsageBytes uint64 `json:"swap_usage_bytes"`
+
+	// processes killed by the OOM killer
+	OOMKills uint64 `json:"oom_kills"`
+}
+
+type PidsMetrics struct {
+	Current uint64 `json:"current"`
+	Limit   uint64 `json:"limit"`
+}
+
+type BlockIOMetrics struct {
+	ReadBytes  uint64 `json:"read_bytes"`
+	WriteBytes uint64 `json:"write_bytes"`
+	ReadOps    uint64 `json:"read_ops"`
+	WriteOps   uint64 `json:"write_ops"`
+}
+
+func decodeMetrics(data *types.Any) (*ContainerMetrics, error) {
+	value, err := typeurl.UnmarshalAny(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch m := value.(type) {
+	case *v1.Metrics:
+		return fromCgroupV1(m), nil
+	case *v2.Metrics:
+		return fromCgroupV2(m), nil
+	default:
+		return nil, fmt.Errorf("unsupported metrics type %s", data.TypeUrl)
+	}
+}
+
+func fromCgroupV1(m *v1.Metrics) *ContainerMetrics {
+	var metrics ContainerMetrics
+
+	if m.CPU != nil {
+		if usage := m.CPU.Usage; usage != nil {
+			metrics.CPU.UsageNanos = usage.Total
+			metrics.CPU.UserNanos = usage.User
+			metrics.CPU.SystemNanos = usage.Kernel
+		}
+
+		if throttling := m.CPU.Throttling; throttling != nil {
+			metrics.CPU.Periods = throttling.Periods
+			metrics.CPU.ThrottledPeriods = throttling.ThrottledPeriods
+			metrics.CPU.ThrottledNanos = throttling.ThrottledTime
+		}
+	}
+
+	if m.Memory != nil {
+		if usage := m.Memory.Usage; usage != nil {
+			metrics.Memory.UsageBytes = usage.Usage
+			metrics.Memory.LimitBytes = usage.Limit
+		}
+
+		if swap := m.Memory.Swap; swap != nil && swap.Usage > metrics.Memory.UsageBytes {
+			// v1 swap accounting includes memory
+			metrics.Memory.SwapUsageBytes = swap.Usage - metrics.Memory.UsageBytes
+		}
+	}
+
+	if m.MemoryOomControl != nil {
+		metrics.Memory.OOMKills = m.MemoryOomControl.OomKill
+	}
+
+	if m.Pids != nil {
+		metrics.Pids.Current = m.Pids.Current
+		metrics.Pids.Limit = m.Pids.Limit
+	}
+
+	if m.Blkio != nil {
+		for _, entry := range m.Blkio.IoServiceBytesRecursive {
+			switch strings.ToLower(entry.Op) {
+			case "read":
+				metrics.BlockIO.ReadBytes += entry.Value
+			case "write":
+				metrics.BlockIO.WriteBytes += entry.Value
+			}
+		}
+
+		for _, entry := range m.Blkio.IoServicedRecursive {
+			switch strings.ToLower(entry.Op) {
+			case "read":
+				metrics.BlockIO.ReadOps += entry.Value
+			case "write":
+				metrics.BlockIO.WriteOps += entry.Value
+			}
+		}
+	}
+
+	return &metrics
+}
+
+func fromCgroupV2(m *v2.Metrics) *ContainerMetrics {
+	var metrics ContainerMetrics
+
+	if cpu := m.CPU; cpu != nil {
+		metrics.CPU.UsageNanos = cpu.UsageUsec * uint64(time.Microsecond)
+		metrics.CPU.UserNanos = cpu.UserUsec * uint64(time.Microsecond)
+		metrics.CPU.SystemNanos = cpu.SystemUsec * uint64(time.Microsecond)
+		metrics.CPU.Periods = cpu.NrPeriods
+		metrics.CPU.ThrottledPeriods = cpu.NrThrottled
+		metrics.CPU.ThrottledNanos = cpu.ThrottledUsec * uint64(time.Microsecond)
+	}
+
+	if memory := m.Memory; memory != nil {
+		metrics.Memory.UsageBytes = memory.Usage
+		metrics.Memory.LimitBytes = memory.UsageLimit
+		metrics.Memory.SwapUsageBytes = memory.SwapUsage
+	}
+
+	if m.MemoryEvents != nil {
+		metrics.Memory.OOMKills = m.MemoryEvents.OomKill
+	}
+
+	if m.Pids != nil {
+		metrics.Pids.Current = m.Pids.Current
+		metrics.Pids.Limit = m.Pids.Limit
+	}
+
+	if m.Io != nil {
+		for _, entry := range m.Io.Usage {
+			metrics.BlockIO.ReadBytes += entry.Rbytes
+			metrics.BlockIO.WriteBytes += entry.Wbytes
+			metrics.BlockIO.ReadOps += entry.Rios
+			metrics.BlockIO.WriteOps += entry.Wios
+		}
+	}
+
+	return &metrics
+}
+
+// processStartTime reads when a host process started from procfs
+func processStartTime(pid uint32) (time.Time, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// the command name may contain spaces, fields are counted after it
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("invalid stat of process %d", pid)
+	}
+
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	bootTime, err := hostBootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return bootTime.Add(time.Duration(ticks) * time.Second / userHZ), nil
+}
+
+func hostBootTime() (time.Time, error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "btime ") {
+			continue
+		}
+
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(line, "btime "), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.Time{}, fmt.Errorf("boot time not found")
+}
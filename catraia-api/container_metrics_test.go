@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	v1 "github.com/containerd/cgroups/stats/v1"
+	v2 "github.com/containerd/cgroups/v2/stats"
+)
+
+func TestMetricsFromCgroupV1(t *testing.T) {
+	m := &v1.Metrics{
+		CPU: &v1.CPUStat{
+			Usage:      &v1.CPUUsage{Total: 300, User: 200, Kernel: 100},
+			Throttling: &v1.Throttle{Periods: 10, ThrottledPeriods: 2, ThrottledTime: 50},
+		},
+		Memory: &v1.MemoryStat{
+			Usage: &v1.MemoryEntry{Usage: 1024, Limit: 4096},
+			Swap:  &v1.MemoryEntry{Usage: 1536},
+		},
+		MemoryOomControl: &v1.MemoryOomControl{OomKill: 1},
+		Pids:             &v1.PidsStat{Current: 3, Limit: 64},
+		Blkio: &v1.BlkIOStat{
+			IoServiceBytesRecursive: []*v1.BlkIOEntry{
+				{Op: "Read", Value: 10},
+				{Op: "Write", Value: 20},
+				{Op: "Total", Value: 30},
+			},
+		},
+	}
+
+	expected := ContainerMetrics{
+		CPU: CPUMetrics{
+			UsageNanos: 300, UserNanos: 200, SystemNanos: 100,
+			Periods: 10, ThrottledPeriods: 2, ThrottledNanos: 50,
+		},
+		Memory:  MemoryMetrics{UsageBytes: 1024, LimitBytes: 4096, SwapUsageBytes: 512, OOMKills: 1},
+		Pids:    PidsMetrics{Current: 3, Limit: 64},
+		BlockIO: BlockIOMetrics{ReadBytes: 10, WriteBytes: 20},
+	}
+
+	if result := fromCgroupV1(m); *result != expected {
+		t.Errorf("want %+v got %+v\n", expected, *result)
+	}
+}
+
+func TestMetricsFromCgroupV2(t *testing.T) {
+	m := &v2.Metrics{
+		CPU:          &v2.CPUStat{UsageUsec: 3, UserUsec: 2, SystemUsec: 1},
+		Memory:       &v2.MemoryStat{Usage: 1024, UsageLimit: 4096},
+		MemoryEvents: &v2.MemoryEvents{OomKill: 2},
+		Io: &v2.IOStat{
+			Usage: []*v2.IOEntry{
+				{Rbytes: 10, Wbytes: 20, Rios: 1, Wios: 2},
+				{Rbytes: 5, Wbytes: 5, Rios: 1, Wios: 1},
+			},
+		},
+	}
+
+	expected := ContainerMetrics{
+		CPU:     CPUMetrics{UsageNanos: 3000, UserNanos: 2000, SystemNanos: 1000},
+		Memory:  MemoryMetrics{UsageBytes: 1024, LimitBytes: 4096, OOMKills: 2},
+		BlockIO: BlockIOMetrics{ReadBytes: 15, WriteBytes: 25, ReadOps: 2, WriteOps: 3},
+	}
+
+	if result := fromCgroupV2(m); *result != expected {
+		t.Errorf("want %+v got %+v\n", expected, *result)
+	}
+}
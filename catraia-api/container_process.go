@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// labels under this prefix are kept for catraia
+const reservedLabelPrefix = "io.catraia."
+
+var (
+	envNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+)
+
+// resources a ulimit may be set for, by their name in lower case without
+// the RLIMIT_ prefix
+var ulimitNames = map[string]bool{
+	"as": true, "core": true, "cpu": true, "data": true, "fsize": true,
+	"locks": true, "memlock": true, "msgqueue": true, "nice": true,
+	"nofile": true, "nproc": true, "rss": true, "rtprio": true,
+	"rttime": true, "sigpending": true, "stack": true,
+}
+
+// EnvVar sets the environment variable Name to Value or to the value of
+// the variable FromHost in the environment of catraia-api
+type EnvVar struct {
+	Name     string `json:"name"`
+	Value    string `json:"value,omitempty"`
+	FromHost string `json:"from_host,omitempty"`
+}
+
+// Ulimit limits a resource of the service processes, as nofile
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft uint64 `json:"soft"`
+	Hard uint64 `json:"hard"`
+}
+
+func (env *EnvVar) validate() error {
+	switch {
+	case !envNamePattern.MatchString(env.Name):
+		return fmt.Errorf("invalid env name %q", env.Name)
+	case env.FromHost != "" && env.Value != "":
+		return fmt.Errorf("env %s has both value and from_host", env.Name)
+	case env.FromHost != "" && !envNamePattern.MatchString(env.FromHost):
+		return fmt.Errorf("invalid host env name %q", env.FromHost)
+	}
+
+	return nil
+}
+
+func (u *Ulimit) validate() error {
+	switch {
+	case !ulimitNames[u.Name]:
+		return fmt.Errorf("unknown ulimit %q", u.Name)
+	case u.Soft > u.Hard:
+		return fmt.Errorf("ulimit %s soft limit above the hard one", u.Name)
+	}
+
+	return nil
+}
+
+// validateProcess checks the overrides of the image process
+func (info *ImageInfo) validateProcess() error {
+	for i := range info.Env {
+		if err := info.Env[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	for i := range info.Ulimits {
+		info.Ulimits[i].Name = strings.ToLower(strings.TrimPrefix(
+			strings.ToUpper(info.Ulimits[i].Name), "RLIMIT_"))
+
+		if err := info.Ulimits[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	if info.WorkingDir != "" && !filepath.IsAbs(info.WorkingDir) {
+		return fmt.Errorf("working_dir %q must be an absolute path", info.WorkingDir)
+	}
+
+	if info.Hostname != "" && !hostnamePattern.MatchString(info.Hostname) {
+		return fmt.Errorf("invalid hostname %q", info.Hostname)
+	}
+
+	for key := range info.Labels {
+		if key == "" || strings.HasPrefix(key, reservedLabelPrefix) {
+			return fmt.Errorf("invalid label %q", key)
+		}
+	}
+
+	return nil
+}
+
+// processOpts applies the image config with the overrides of the service
+// process. An entrypoint replaces the one of the image along with its cmd,
+// as in docker.
+func (info *ImageInfo) processOpts(image containerd.Image) []oci.SpecOpts {
+	opts := []oci.SpecOpts{oci.WithImageConfigArgs(image, info.Cmd)}
+
+	if len(info.Entrypoint) > 0 {
+		args := append(append([]string{}, info.Entrypoint...), info.Cmd...)
+		opts = append(opts, oci.WithProcessArgs(args...))
+	}
+
+	if len(info.Env) > 0 {
+		opts = append(opts, withEnvVars(info.Env))
+	}
+
+	if info.WorkingDir != "" {
+		opts = append(opts, oci.WithProcessCwd(info.WorkingDir))
+	}
+
+	if info.Hostname != "" {
+		opts = append(opts, oci.WithHostname(info.Hostname))
+	}
+
+	// labels are also annotations so that the spec hash covers them
+	if len(info.Labels) > 0 {
+		opts = append(opts, oci.WithAnnotations(info.Labels))
+	}
+
+	if len(info.Ulimits) > 0 {
+		opts = append(opts, withUlimits(info.Ulimits))
+	}
+
+	return opts
+}
+
+// withEnvVars resolves variables taken from the host when the spec is
+// generated, so a change to them rolls out a new container
+func withEnvVars(vars []EnvVar) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, s *oci.Spec) error {
+		env := make([]string, 0, len(vars))
+		for _, v := range vars {
+			value := v.Value
+			if v.FromHost != "" {
+				var ok bool
+				if value, ok = os.LookupEnv(v.FromHost); !ok {
+					return fmt.Errorf("host env %s of %s is not set", v.FromHost, v.Name)
+				}
+			}
+
+			env = append(env, v.Name+"="+value)
+		}
+
+		return oci.WithEnv(env)(ctx, client, c, s)
+	}
+}
+
+// withUlimits replaces the rlimits of the same resources
+func withUlimits(ulimits []Ulimit) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, s *oci.Spec) error {
+		for _, u := range ulimits {
+			rlimit := specs.POSIXRlimit{
+				Type: "RLIMIT_" + strings.ToUpper(u.Name),
+				Soft: u.Soft,
+				Hard: u.Hard,
+			}
+
+			replaced := false
+			for i := range s.Process.Rlimits {
+				if s.Process.Rlimits[i].Type == rlimit.Type {
+					s.Process.Rlimits[i] = rlimit
+					replaced = true
+				}
+			}
+
+			if !replaced {
+				s.Process.Rlimits = append(s.Process.Rlimits, rlimit)
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseProcess(t *testing.T) {
+	jsonData := `
+        {
+          "helloweb" : {
+            "ref" : "docker.io/renatofq/helloweb:latest",
+            "cmd" : [ "--port", "8080" ],
+            "env" : [ { "name" : "MODE", "value" : "prod" }, { "name" : "TOKEN", "from_host" : "HELLO_TOKEN" } ],
+            "working_dir" : "/srv",
+            "hostname" : "helloweb",
+            "labels" : { "team" : "web" },
+            "ulimits" : [ { "name" : "RLIMIT_NOFILE", "soft" : 4096, "hard" : 8192 } ]
+          }
+        }
+`
+
+	result, err := parseInfoData(strings.NewReader(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Ulimit{{Name: "nofile", Soft: 4096, Hard: 8192}}
+	if !reflect.DeepEqual(result["helloweb"].Ulimits, expected) {
+		t.Errorf("want %v got %v\n", expected, result["helloweb"].Ulimits)
+	}
+
+	invalid := []string{
+		`{ "helloweb" : { "env" : [ { "name" : "A=B" } ] } }`,
+		`{ "helloweb" : { "env" : [ { "name" : "A", "value" : "b", "from_host" : "B" } ] } }`,
+		`{ "helloweb" : { "working_dir" : "srv" } }`,
+		`{ "helloweb" : { "hostname" : "hello_web" } }`,
+		`{ "helloweb" : { "labels" : { "io.catraia.service" : "other" } } }`,
+		`{ "helloweb" : { "ulimits" : [ { "name" : "files", "soft" : 1, "hard" : 1 } ] } }`,
+		`{ "helloweb" : { "ulimits" : [ { "name" : "nofile", "soft" : 2, "hard" : 1 } ] } }`,
+	}
+	for _, data := range invalid {
+		if _, err := parseInfoData(strings.NewReader(data)); err == nil {
+			t.Errorf("invalid process accepted: %s\n", data)
+		}
+	}
+}
+
+func TestProcessSpec(t *testing.T) {
+	os.Setenv("CATRAIA_TEST_TOKEN", "secret")
+	defer os.Unsetenv("CATRAIA_TEST_TOKEN")
+
+	spec := &oci.Spec{
+		Process: &specs.Process{
+			Env:     []string{"PATH=/bin", "MODE=dev"},
+			Rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 1024}},
+		},
+	}
+
+	opts := []oci.SpecOpts{
+		withEnvVars([]EnvVar{
+			{Name: "MODE", Value: "prod"},
+			{Name: "TOKEN", FromHost: "CATRAIA_TEST_TOKEN"},
+		}),
+		withUlimits([]Ulimit{
+			{Name: "nofile", Soft: 4096, Hard: 8192},
+			{Name: "nproc", Soft: 64, Hard: 64},
+		}),
+	}
+	for _, opt := range opts {
+		if err := opt(context.Background(), nil, &containers.Container{}, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectedEnv := []string{"PATH=/bin", "MODE=prod", "TOKEN=secret"}
+	if !reflect.DeepEqual(spec.Process.Env, expectedEnv) {
+		t.Errorf("want %v got %v\n", expectedEnv, spec.Process.Env)
+	}
+
+	expectedRlimits := []specs.POSIXRlimit{
+		{Type: "RLIMIT_NOFILE", Soft: 4096, Hard: 8192},
+		{Type: "RLIMIT_NPROC", Soft: 64, Hard: 64},
+	}
+	if !reflect.DeepEqual(spec.Process.Rlimits, expectedRlimits) {
+		t.Errorf("want %v got %v\n", expectedRlimits, spec.Process.Rlimits)
+	}
+
+	missing := withEnvVars([]EnvVar{{Name: "TOKEN", FromHost: "CATRAIA_TEST_MISSING"}})
+	if err := missing(context.Background(), nil, &containers.Container{}, spec); err == nil {
+		t.Error("missing host env accepted")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// CFS period used when CPUs or a quota are given without one
+const defaultCPUPeriod = 100000
+
+// CPU shares of a cgroup without any set
+const defaultCPUShares = 1024
+
+// Resources limits what a service takes from the host. Memory and
+// MemorySwap, the total of memory and swap or -1 for unlimited swap, accept
+// k, m and g suffixes. CPUs is a fractional number of CPUs, exclusive with
+// CPUQuota. PidsLimit zero means no limit.
+type Resources struct {
+	Memory      string  `json:"memory,omitempty"`
+	MemorySwap  string  `json:"memory_swap,omitempty"`
+	CPUs        float64 `json:"cpus,omitempty"`
+	CPUQuota    int64   `json:"cpu_quota,omitempty"`
+	CPUPeriod   uint64  `json:"cpu_period,omitempty"`
+	CPUShares   uint64  `json:"cpu_shares,omitempty"`
+	CpusetCPUs  string  `json:"cpuset_cpus,omitempty"`
+	CpusetMems  string  `json:"cpuset_mems,omitempty"`
+	PidsLimit   int64   `json:"pids_limit,omitempty"`
+	OOMScoreAdj *int    `json:"oom_score_adj,omitempty"`
+}
+
+func (r *Resources) validate() error {
+	memory, err := parseBytes(r.Memory)
+	if err != nil {
+		return fmt.Errorf("invalid memory: %v", err)
+	}
+
+	if r.MemorySwap != "" && memory == 0 {
+		return errors.New("memory_swap needs a memory limit")
+	}
+
+	if r.MemorySwap != "" && r.MemorySwap != "-1" {
+		swap, err := parseBytes(r.MemorySwap)
+		if err != nil {
+			return fmt.Errorf("invalid memory_swap: %v", err)
+		}
+
+		if swap < memory {
+			return errors.New("memory_swap must not be less than memory")
+		}
+	}
+
+	switch {
+	case r.CPUs < 0:
+		return errors.New("cpus must not be negative")
+	case r.CPUs > 0 && r.CPUQuota != 0:
+		return errors.New("cpus and cpu_quota are exclusive")
+	case r.CPUQuota < 0:
+		return errors.New("cpu_quota must not be negative")
+	case r.CPUPeriod != 0 && (r.CPUPeriod < 1000 || r.CPUPeriod > 1000000):
+		return errors.New("cpu_period must be between 1000 and 1000000")
+	case r.CPUShares != 0 && (r.CPUShares < 2 || r.CPUShares > 262144):
+		return errors.New("cpu_shares must be between 2 and 262144")
+	case r.PidsLimit < 0:
+		return errors.New("pids_limit must not be negative")
+	case r.OOMScoreAdj != nil && (*r.OOMScoreAdj < -1000 || *r.OOMScoreAdj > 1000):
+		return errors.New("oom_score_adj must be between -1000 and 1000")
+	}
+
+	if _, err := parseCPUSet(r.CpusetCPUs); err != nil {
+		return fmt.Errorf("invalid cpuset_cpus: %v", err)
+	}
+
+	if _, err := parseCPUSet(r.CpusetMems); err != nil {
+		return fmt.Errorf("invalid cpuset_mems: %v", err)
+	}
+
+	return nil
+}
+
+// checkCapacity refuses limits the host can not provide
+func (r *Resources) checkCapacity() error {
+	cpus := runtime.NumCPU()
+
+	if quota, period := r.cfs(); quota > 0 && float64(quota)/float64(period) > float64(cpus) {
+		return fmt.Errorf("cpu limit above the %d CPUs of the host", cpus)
+	}
+
+	set, _ := parseCPUSet(r.CpusetCPUs)
+	for _, cpu := range set {
+		if cpu >= cpus {
+			return fmt.Errorf("cpuset_cpus holds CPU %d, the host has %d", cpu, cpus)
+		}
+	}
+
+	memory, _ := parseBytes(r.Memory)
+	if memory > 0 {
+		var info syscall.Sysinfo_t
+		if err := syscall.Sysinfo(&info); err != nil {
+			return err
+		}
+
+		if total := int64(info.Totalram) * int64(info.Unit); memory > total {
+			return fmt.Errorf("memory limit above the %d bytes of the host", total)
+		}
+	}
+
+	return nil
+}
+
+// cfs returns the CFS quota and period of the CPU limit, none when the
+// quota is zero
+func (r *Resources) cfs() (int64, uint64) {
+	period := r.CPUPeriod
+	if period == 0 {
+		period = defaultCPUPeriod
+	}
+
+	if r.CPUs > 0 {
+		return int64(math.Ceil(r.CPUs * float64(period))), period
+	}
+
+	return r.CPUQuota, period
+}
+
+// specOpts applies the limits to the spec of a service. Limits are
+// validated when service info is loaded.
+func (r *Resources) specOpts() []oci.SpecOpts {
+	var opts []oci.SpecOpts
+
+	if memory, _ := parseBytes(r.Memory); memory > 0 {
+		opts = append(opts, oci.WithMemoryLimit(uint64(memory)))
+	}
+
+	if r.MemorySwap != "" {
+		swap := int64(-1)
+		if r.MemorySwap != "-1" {
+			swap, _ = parseBytes(r.MemorySwap)
+		}
+		opts = append(opts, withMemorySwap(swap))
+	}
+
+	if quota, period := r.cfs(); quota > 0 {
+		opts = append(opts, oci.WithCPUCFS(quota, period))
+	}
+
+	if r.CPUShares > 0 {
+		opts = append(opts, oci.WithCPUShares(r.CPUShares))
+	}
+
+	if r.CpusetCPUs != "" {
+		opts = append(opts, oci.WithCPUs(r.CpusetCPUs))
+	}
+
+	if r.CpusetMems != "" {
+		opts = append(opts, oci.WithCPUsMems(r.CpusetMems))
+	}
+
+	if r.PidsLimit > 0 {
+		opts = append(opts, oci.WithPidsLimit(r.PidsLimit))
+	}
+
+	if r.OOMScoreAdj != nil {
+		opts = append(opts, withOOMScoreAdj(*r.OOMScoreAdj))
+	}
+
+	return opts
+}
+
+func withMemorySwap(swap int64) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, s *oci.Spec) error {
+		if s.Linux == nil || s.Linux.Resources == nil || s.Linux.Resources.Memory == nil {
+			return errors.New("memory_swap needs a memory limit")
+		}
+
+		s.Linux.Resources.Memory.Swap = &swap
+		return nil
+	}
+}
+
+func withOOMScoreAdj(adj int) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, s *oci.Spec) error {
+		s.Process.OOMScoreAdj = &adj
+		return nil
+	}
+}
+
+// updateResources applies new limits to the active container of a service
+// when they are all that changed in its spec, updating the cgroups of its
+// task in place. It tells whether it did.
+func (c *service) updateResources(ctx context.Context, id string,
+	current *containerGeneration, image containerd.Image, spec *oci.Spec,
+	hash string) (bool, error) {
+
+	currentImage, err := current.container.Image(ctx)
+	if err != nil || currentImage.Target().Digest != image.Target().Digest {
+		return false, nil
+	}
+
+	currentSpec, err := current.container.Spec(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	candidate, ok := candidateSpec(currentSpec, spec)
+	if !ok {
+		return false, nil
+	}
+
+	candidateHash, err := specHash(candidate, image)
+	if err != nil || candidateHash != hash {
+		return false, err
+	}
+
+	resources, ok := runtimeResources(currentSpec.Linux.Resources, candidate.Linux.Resources)
+	if !ok {
+		return false, nil
+	}
+
+	log.Printf("Resources of service %s changed, updating container %s\n",
+		id, current.container.ID())
+
+	task, err := current.container.Task(ctx, nil)
+	if err == nil {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		if status.Status != containerd.Stopped {
+			if err := task.Update(ctx, containerd.WithResources(resources)); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	err = current.container.Update(ctx, containerd.UpdateContainerOpts(containerd.WithSpec(candidate)))
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := current.container.SetLabels(ctx, map[string]string{specHashLabel: hash}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// candidateSpec is the current spec of a container with the limits of the
+// new one, keeping its cgroups path
+func candidateSpec(current, spec *oci.Spec) (*oci.Spec, bool) {
+	if current.Linux == nil || spec.Linux == nil {
+		return nil, false
+	}
+
+	candidate := *current
+	linux := *current.Linux
+	linux.Resources = spec.Linux.Resources
+	candidate.Linux = &linux
+
+	return &candidate, true
+}
+
+// runtimeResources are the limits to update a task with. The runtime only
+// changes the limits it is given, so removed ones are given as unlimited.
+// A removed cpuset has no such value and needs a new container.
+func runtimeResources(current, next *specs.LinuxResources) (*specs.LinuxResources, bool) {
+	resources := &specs.LinuxResources{}
+	if next != nil {
+		copied := *next
+		resources = &copied
+	}
+
+	if current == nil {
+		return resources, true
+	}
+
+	unlimited := int64(-1)
+
+	if current.Memory != nil {
+		memory := specs.LinuxMemory{}
+		if resources.Memory != nil {
+			memory = *resources.Memory
+		}
+
+		if current.Memory.Limit != nil && memory.Limit == nil {
+			memory.Limit = &unlimited
+		}
+
+		if (current.Memory.Swap != nil || current.Memory.Limit != nil) && memory.Swap == nil {
+			memory.Swap = &unlimited
+		}
+
+		resources.Memory = &memory
+	}
+
+	if current.CPU != nil {
+		cpu := specs.LinuxCPU{}
+		if resources.CPU != nil {
+			cpu = *resources.CPU
+		}
+
+		if current.CPU.Cpus != "" && cpu.Cpus == "" || current.CPU.Mems != "" && cpu.Mems == "" {
+			return nil, false
+		}
+
+		if current.CPU.Quota != nil && cpu.Quota == nil {
+			cpu.Quota = &unlimited
+		}
+
+		if current.CPU.Shares != nil && cpu.Shares == nil {
+			shares := uint64(defaultCPUShares)
+			cpu.Shares = &shares
+		}
+
+		resources.CPU = &cpu
+	}
+
+	if current.Pids != nil && resources.Pids == nil {
+		resources.Pids = &specs.LinuxPids{Limit: unlimited}
+	}
+
+	return resources, true
+}
+
+// parseBytes reads a size in bytes with an optional k, m or g suffix
+func parseBytes(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q too large", value)
+	}
+
+	return n * multiplier, nil
+}
+
+// parseCPUSet reads a cpuset list as 0-2,4
+func parseCPUSet(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var set []int
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid cpuset %q", value)
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first || last-first > 4096 {
+				return nil, fmt.Errorf("invalid cpuset %q", value)
+			}
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			set = append(set, cpu)
+		}
+	}
+
+	return set, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseResources(t *testing.T) {
+	jsonData := `
+        {
+          "helloweb" : {
+            "ref" : "docker.io/renatofq/helloweb:latest",
+            "resources" : {
+              "memory" : "256m",
+              "memory_swap" : "512m",
+              "cpus" : 0.5,
+              "cpu_shares" : 512,
+              "cpuset_cpus" : "0",
+              "pids_limit" : 64,
+              "oom_score_adj" : 500
+            }
+          }
+        }
+`
+
+	result, err := parseInfoData(strings.NewReader(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resources := result["helloweb"].Resources
+	if err := resources.checkCapacity(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &oci.Spec{
+		Process: &specs.Process{},
+		Linux:   &specs.Linux{},
+	}
+	for _, opt := range resources.specOpts() {
+		if err := opt(context.Background(), nil, &containers.Container{}, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limits := s.Linux.Resources
+	if *limits.Memory.Limit != 256<<20 || *limits.Memory.Swap != 512<<20 {
+		t.Errorf("want 256m/512m got %d/%d\n", *limits.Memory.Limit, *limits.Memory.Swap)
+	}
+
+	if *limits.CPU.Quota != 50000 || *limits.CPU.Period != defaultCPUPeriod {
+		t.Errorf("want half a CPU got %d/%d\n", *limits.CPU.Quota, *limits.CPU.Period)
+	}
+
+	if *limits.CPU.Shares != 512 || limits.CPU.Cpus != "0" || limits.Pids.Limit != 64 {
+		t.Errorf("want shares, cpuset and pids set got %+v %+v\n", limits.CPU, limits.Pids)
+	}
+
+	if *s.Process.OOMScoreAdj != 500 {
+		t.Errorf("want oom score adj 500 got %d\n", *s.Process.OOMScoreAdj)
+	}
+
+	invalid := []string{
+		`{ "memory" : "lots" }`,
+		`{ "memory_swap" : "1g" }`,
+		`{ "memory" : "1g", "memory_swap" : "512m" }`,
+		`{ "cpus" : 1, "cpu_quota" : 50000 }`,
+		`{ "cpu_shares" : 1 }`,
+		`{ "cpuset_cpus" : "3-1" }`,
+		`{ "oom_score_adj" : 1001 }`,
+	}
+	for _, data := range invalid {
+		info := `{ "helloweb" : { "resources" : ` + data + ` } }`
+		if _, err := parseInfoData(strings.NewReader(info)); err == nil {
+			t.Errorf("invalid resources accepted: %s\n", data)
+		}
+	}
+}
+
+func TestCheckCapacity(t *testing.T) {
+	tooMany := []Resources{
+		{CPUs: 1 << 20},
+		{CpusetCPUs: "0-4096"},
+		{Memory: "1048576g"},
+	}
+
+	for _, r := range tooMany {
+		if err := r.checkCapacity(); err == nil {
+			t.Errorf("want %+v above host capacity\n", r)
+		}
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	set, err := parseCPUSet("0-2,5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{0, 1, 2, 5}; !reflect.DeepEqual(set, want) {
+		t.Errorf("want %v got %v\n", want, set)
+	}
+}
+
+func TestRemovedLimits(t *testing.T) {
+	limit, swap, quota := int64(1<<20), int64(2<<20), int64(50000)
+	period, shares := uint64(100000), uint64(512)
+
+	current := &oci.Spec{Linux: &specs.Linux{
+		CgroupsPath: "/catraia/helloweb-g1",
+		Resources: &specs.LinuxResources{
+			Memory: &specs.LinuxMemory{Limit: &limit, Swap: &swap},
+			CPU:    &specs.LinuxCPU{Quota: &quota, Period: &period, Shares: &shares},
+			Pids:   &specs.LinuxPids{Limit: 100},
+		},
+	}}
+	spec := &oci.Spec{Linux: &specs.Linux{
+		CgroupsPath: "/catraia/helloweb-g2",
+		Resources:   &specs.LinuxResources{},
+	}}
+
+	candidate, ok := candidateSpec(current, spec)
+	if !ok {
+		t.Fatal("want a candidate spec")
+	}
+
+	if candidate.Linux.CgroupsPath != "/catraia/helloweb-g1" {
+		t.Errorf("want cgroups path kept got %s\n", candidate.Linux.CgroupsPath)
+	}
+
+	if !reflect.DeepEqual(candidate.Linux.Resources, spec.Linux.Resources) {
+		t.Errorf("want limits %v got %v\n", spec.Linux.Resources, candidate.Linux.Resources)
+	}
+
+	if current.Linux.Resources.Memory == nil {
+		t.Errorf("want current spec untouched\n")
+	}
+
+	resources, ok := runtimeResources(current.Linux.Resources, candidate.Linux.Resources)
+	if !ok {
+		t.Fatal("want resources updated in place")
+	}
+
+	switch {
+	case resources.Memory == nil || *resources.Memory.Limit != -1 || *resources.Memory.Swap != -1:
+		t.Errorf("want unlimited memory got %v\n", resources.Memory)
+	case resources.CPU == nil || *resources.CPU.Quota != -1 || *resources.CPU.Shares != defaultCPUShares:
+		t.Errorf("want unlimited cpu got %v\n", resources.CPU)
+	case resources.Pids == nil || resources.Pids.Limit != -1:
+		t.Errorf("want unlimited pids got %v\n", resources.Pids)
+	}
+
+	if candidate.Linux.Resources.Memory != nil {
+		t.Errorf("want candidate spec without memory limit got %v\n", candidate.Linux.Resources.Memory)
+	}
+
+	kept := &specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: &swap}}
+	if resources, _ := runtimeResources(current.Linux.Resources, kept); *resources.Memory.Limit != swap {
+		t.Errorf("want memory limit %d got %d\n", swap, *resources.Memory.Limit)
+	}
+
+	cpuset := &specs.LinuxResources{CPU: &specs.LinuxCPU{Cpus: "0-1"}}
+	if _, ok := runtimeResources(cpuset, &specs.LinuxResources{}); ok {
+		t.Errorf("want a removed cpuset to need a new container\n")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+)
+
+// Every deploy that changes the spec of a service creates a new generation
+// of its container. The proxy is switched to the new generation once it is
+// ready and the previous ones are removed after draining.
+const (
+	serviceLabel    = "io.catraia.service"
+	generationLabel = "io.catraia.generation"
+
+	// set on the generation the proxy routes to
+	activeLabel = "io.catraia.active"
+)
+
+const (
+	// interval between readiness checks of a new generation
+	readinessInterval = 500 * time.Millisecond
+
+	// time given to in-flight requests to the previous generation before
+	// it is removed
+	drainPeriod = 5 * time.Second
+)
+
+type containerGeneration struct {
+	container containerd.Container
+	labels    map[string]string
+	number    int
+}
+
+func generationID(id string, number int) string {
+	return fmt.Sprintf("%s-g%d", id, number)
+}
+
+// serviceGenerations lists the containers of a service ordered by
+// generation. A container named after the service, created before
+// generations existed, is taken as generation zero.
+func serviceGenerations(ctx context.Context, client *containerd.Client,
+	id string) ([]*containerGeneration, error) {
+
+	containers, err := client.Containers(ctx, fmt.Sprintf("labels.%q==%q", serviceLabel, id))
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy, err := client.LoadContainer(ctx, id); err == nil {
+		containers = append(containers, legacy)
+	} else if !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+
+	generations := make([]*containerGeneration, 0, len(containers))
+	for _, container := range containers {
+		labels, err := container.Labels(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		number, _ := strconv.Atoi(labels[generationLabel])
+		generations = append(generations, &containerGeneration{
+			container: container,
+			labels:    labels,
+			number:    number,
+		})
+	}
+
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].number < generations[j].number
+	})
+
+	return generations, nil
+}
+
+// activeGeneration returns the latest generation routed by the proxy. When
+// none is marked, as for containers created before generations, the oldest
+// one is taken.
+func activeGeneration(generations []*containerGeneration) *containerGeneration {
+	for i := len(generations) - 1; i >= 0; i-- {
+		if generations[i].labels[activeLabel] == "true" {
+			return generations[i]
+		}
+	}
+
+	if len(generations) > 0 {
+		return generations[0]
+	}
+
+	return nil
+}
+
+func nextGeneration(generations []*containerGeneration) int {
+	if len(generations) == 0 {
+		return 1
+	}
+
+	return generations[len(generations)-1].number + 1
+}
+
+// loadActiveContainer loads the container currently serving a service
+func loadActiveContainer(ctx context.Context, client *containerd.Client,
+	id string) (containerd.Container, error) {
+
+	generations, err := serviceGenerations(ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+
+	active := activeGeneration(generations)
+	if active == nil {
+		return nil, fmt.Errorf("service %s has no container: %w", id, errdefs.ErrNotFound)
+	}
+
+	return active.container, nil
+}
+
+// startGeneration starts the task of a new generation and switches the
+// proxy to it once ready. The container is removed if it fails.
+func (c *service) startGeneration(ctx context.Context, imageInfo *ImageInfo,
+	container containerd.Container, progress Progress) (_ containerd.Task, errRet error) {
+
+	defer func() {
+		if errRet == nil {
+			return
+		}
+
+		log.Printf("Removing failed container %s\n", container.ID())
+		if err := deleteContainer(ctx, container); err != nil {
+			log.Printf("Fail to remove container %s: %v\n", container.ID(), err)
+		}
+		c.unroute(container.ID())
+	}()
+
+	task, err := c.createTask(ctx, imageInfo.ID, container, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	progress.Phase(PhaseChecking)
+	if err := c.waitReady(ctx, task, container.ID(), imageInfo.Readiness); err != nil {
+		return nil, err
+	}
+
+	if err := c.router.Route(imageInfo.ID, container.ID()); err != nil {
+		return nil, err
+	}
+
+	if _, err := container.SetLabels(ctx, map[string]string{activeLabel: "true"}); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Service %s switched to container %s\n", imageInfo.ID, container.ID())
+
+	return task, nil
+}
+
+// waitReady polls the readiness check of a container through the proxy
+// until it passes, the task exits or the check times out
+func (c *service) waitReady(ctx context.Context, task containerd.Task,
+	containerID string, check ReadinessCheck) error {
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.Timeout)*time.Second)
+	defer cancel()
+
+	log.Printf("Waiting for container %s to get ready\n", containerID)
+	for {
+		err := c.router.Probe(ctx, containerID, check.Path)
+		if err == nil {
+			return nil
+		}
+
+		if status, statusErr := task.Status(ctx); statusErr == nil &&
+			status.Status == containerd.Stopped {
+			return fmt.Errorf("container %s exited with status %d before getting ready",
+				containerID, status.ExitStatus)
+		}
+
+		select {
+		case <-time.After(readinessInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("container %s not ready after %ds: %v",
+				containerID, check.Timeout, err)
+		}
+	}
+}
+
+// drain removes previous generations of a service, after waiting for their
+// in-flight requests when wait is set
+func (c *service) drain(ctx context.Context, id string,
+	stale []containerd.Container, wait bool) {
+
+	if wait {
+		select {
+		case <-time.After(drainPeriod):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	for _, container := range stale {
+		log.Printf("Removing container %s\n", container.ID())
+		if err := deleteContainer(ctx, container); err != nil {
+			log.Printf("Fail to remove container %s: %v\n", container.ID(), err)
+			continue
+		}
+
+		// a container named after the service shares its endpoint entry
+		if container.ID() != id {
+			c.unroute(container.ID())
+		}
+	}
+}
+
+func (c *service) unroute(id string) {
+	if err := c.router.Unroute(id); err != nil {
+		log.Printf("Fail to remove endpoint %s: %v\n", id, err)
+	}
+}
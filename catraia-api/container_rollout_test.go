@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestActiveGeneration(t *testing.T) {
+	generations := []*containerGeneration{
+		{labels: map[string]string{}, number: 0},
+		{labels: map[string]string{activeLabel: "true"}, number: 1},
+		{labels: map[string]string{activeLabel: "true"}, number: 2},
+		{labels: map[string]string{}, number: 3},
+	}
+
+	if active := activeGeneration(generations); active != generations[2] {
+		t.Errorf("want generation 2 got %d\n", active.number)
+	}
+
+	if next := nextGeneration(generations); next != 4 {
+		t.Errorf("want next generation 4 got %d\n", next)
+	}
+
+	legacy := generations[:1]
+	if active := activeGeneration(legacy); active != legacy[0] {
+		t.Errorf("want legacy generation got %d\n", active.number)
+	}
+
+	if active := activeGeneration(nil); active != nil {
+		t.Errorf("want no generation got %d\n", active.number)
+	}
+
+	if next := nextGeneration(nil); next != 1 {
+		t.Errorf("want first generation 1 got %d\n", next)
+	}
+}
+
+func TestGenerationID(t *testing.T) {
+	if id := generationID("helloweb", 3); id != "helloweb-g3" {
+		t.Errorf("want helloweb-g3 got %s\n", id)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/contrib/seccomp"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Seccomp profiles besides a path to a profile file
+const (
+	SeccompDefault    = "default"
+	SeccompUnconfined = "unconfined"
+)
+
+// capabilities of services that do not add or drop any
+var defaultCapabilities = []string{"CAP_NET_BIND_SERVICE"}
+
+var (
+	capabilityPattern = regexp.MustCompile(`^CAP_[A-Z0-9_]+$`)
+	userPattern       = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+)
+
+// SecurityProfile restricts what a service may do. CapAdd and CapDrop,
+// which takes ALL, change the default capabilities. Seccomp is the default
+// profile unless unconfined or the path of a profile. NoNewPrivileges is
+// set unless false. User runs the service as uid[:gid], the group being
+// the uid by default.
+type SecurityProfile struct {
+	CapAdd          []string `json:"cap_add,omitempty"`
+	CapDrop         []string `json:"cap_drop,omitempty"`
+	Seccomp         string   `json:"seccomp,omitempty"`
+	ReadOnlyRootfs  bool     `json:"read_only_rootfs,omitempty"`
+	Tmpfs           []Tmpfs  `json:"tmpfs,omitempty"`
+	NoNewPrivileges *bool    `json:"no_new_privileges,omitempty"`
+	User            string   `json:"user,omitempty"`
+	MaskedPaths     []string `json:"masked_paths,omitempty"`
+	ReadonlyPaths   []string `json:"readonly_paths,omitempty"`
+}
+
+// Tmpfs is a writable in-memory directory, mostly for services with a
+// read-only root filesystem
+type Tmpfs struct {
+	Target string `json:"target"`
+	Size   string `json:"size,omitempty"`
+}
+
+func (sp *SecurityProfile) validate() error {
+	for i, c := range sp.CapAdd {
+		if sp.CapAdd[i] = normalizeCapability(c); !capabilityPattern.MatchString(sp.CapAdd[i]) {
+			return fmt.Errorf("invalid capability %q", c)
+		}
+	}
+
+	for i, c := range sp.CapDrop {
+		if strings.EqualFold(c, "ALL") {
+			sp.CapDrop[i] = "ALL"
+			continue
+		}
+
+		if sp.CapDrop[i] = normalizeCapability(c); !capabilityPattern.MatchString(sp.CapDrop[i]) {
+			return fmt.Errorf("invalid capability %q", c)
+		}
+	}
+
+	switch sp.Seccomp {
+	case "", SeccompDefault, SeccompUnconfined:
+	default:
+		if !filepath.IsAbs(sp.Seccomp) {
+			return fmt.Errorf("seccomp profile %q must be an absolute path", sp.Seccomp)
+		}
+	}
+
+	if sp.User != "" && !userPattern.MatchString(sp.User) {
+		return fmt.Errorf("invalid user %q, uid[:gid] expected", sp.User)
+	}
+
+	for _, t := range sp.Tmpfs {
+		if !filepath.IsAbs(t.Target) {
+			return fmt.Errorf("tmpfs target %q must be an absolute path", t.Target)
+		}
+
+		if _, err := parseBytes(t.Size); err != nil {
+			return fmt.Errorf("invalid tmpfs size: %v", err)
+		}
+	}
+
+	for _, path := range append(sp.MaskedPaths, sp.ReadonlyPaths...) {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("path %q must be absolute", path)
+		}
+	}
+
+	return nil
+}
+
+func normalizeCapability(c string) string {
+	c = strings.ToUpper(c)
+	if !strings.HasPrefix(c, "CAP_") {
+		c = "CAP_" + c
+	}
+
+	return c
+}
+
+// capabilities returns the default capabilities changed by the profile
+func (sp *SecurityProfile) capabilities() []string {
+	var caps []string
+	for _, c := range defaultCapabilities {
+		if !sp.drops(c) {
+			caps = append(caps, c)
+		}
+	}
+
+	for _, c := range sp.CapAdd {
+		if !containsString(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+
+	return caps
+}
+
+func (sp *SecurityProfile) drops(c string) bool {
+	return containsString(sp.CapDrop, "ALL") || containsString(sp.CapDrop, c)
+}
+
+// specOpts applies the profile to the spec of a service. The seccomp
+// profile comes last, as the default one allows calls by capability.
+func (sp *SecurityProfile) specOpts() []oci.SpecOpts {
+	opts := []oci.SpecOpts{
+		oci.WithCapabilities(sp.capabilities()),
+	}
+
+	if sp.NoNewPrivileges == nil || *sp.NoNewPrivileges {
+		opts = append(opts, oci.WithNoNewPrivileges)
+	}
+
+	if sp.ReadOnlyRootfs {
+		opts = append(opts, oci.WithRootFSReadonly())
+	}
+
+	if len(sp.Tmpfs) > 0 {
+		opts = append(opts, oci.WithMounts(sp.tmpfsMounts()))
+	}
+
+	if sp.User != "" {
+		opts = append(opts, withUser(sp.User))
+	}
+
+	if len(sp.MaskedPaths) > 0 || len(sp.ReadonlyPaths) > 0 {
+		opts = append(opts, withExtraPaths(sp.MaskedPaths, sp.ReadonlyPaths))
+	}
+
+	switch sp.Seccomp {
+	case SeccompUnconfined:
+	case SeccompDefault, "":
+		opts = append(opts, seccomp.WithDefaultProfile())
+	default:
+		opts = append(opts, seccomp.WithProfile(sp.Seccomp))
+	}
+
+	return opts
+}
+
+func (sp *SecurityProfile) tmpfsMounts() []specs.Mount {
+	mounts := make([]specs.Mount, 0, len(sp.Tmpfs))
+	for _, t := range sp.Tmpfs {
+		options := []string{"nosuid", "nodev", "noexec", "mode=1777"}
+		if size, _ := parseBytes(t.Size); size > 0 {
+			options = append(options, "size="+strconv.FormatInt(size, 10))
+		}
+
+		mounts = append(mounts, specs.Mount{
+			Destination: t.Target,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     options,
+		})
+	}
+
+	return mounts
+}
+
+// withUser sets a numeric user, which needs no lookup in the image
+func withUser(user string) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, s *oci.Spec) error {
+		parts := strings.SplitN(user, ":", 2)
+
+		uid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return err
+		}
+
+		gid := uid
+		if len(parts) == 2 {
+			if gid, err = strconv.ParseUint(parts[1], 10, 32); err != nil {
+				return err
+			}
+		}
+
+		if s.Process == nil {
+			return errors.New("spec has no process")
+		}
+
+		s.Process.User.UID = uint32(uid)
+		s.Process.User.GID = uint32(gid)
+		s.Process.User.AdditionalGids = nil
+		return nil
+	}
+}
+
+// withExtraPaths masks or makes read-only paths besides the default ones
+func withExtraPaths(masked, readonly []string) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, s *oci.Spec) error {
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+
+		s.Linux.MaskedPaths = append(s.Linux.MaskedPaths, masked...)
+		s.Linux.ReadonlyPaths = append(s.Linux.ReadonlyPaths, readonly...)
+		return nil
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseSecurity(t *testing.T) {
+	jsonData := `
+        {
+          "helloweb" : {
+            "ref" : "docker.io/renatofq/helloweb:latest",
+            "security" : {
+              "cap_add" : [ "net_raw" ],
+              "cap_drop" : [ "all" ],
+              "read_only_rootfs" : true,
+              "tmpfs" : [ { "target" : "/tmp", "size" : "64m" } ],
+              "user" : "1000:1000"
+            }
+          }
+        }
+`
+
+	result, err := parseInfoData(strings.NewReader(jsonData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	security := result["helloweb"].Security
+
+	expected := []string{"CAP_NET_RAW"}
+	if caps := security.capabilities(); !reflect.DeepEqual(caps, expected) {
+		t.Errorf("want %v got %v\n", expected, caps)
+	}
+
+	invalid := []string{
+		`{ "helloweb" : { "security" : { "cap_add" : [ "net raw" ] } } }`,
+		`{ "helloweb" : { "security" : { "seccomp" : "profile.json" } } }`,
+		`{ "helloweb" : { "security" : { "user" : "nobody" } } }`,
+		`{ "helloweb" : { "security" : { "tmpfs" : [ { "target" : "tmp" } ] } } }`,
+		`{ "helloweb" : { "security" : { "masked_paths" : [ "proc/kcore" ] } } }`,
+	}
+	for _, data := range invalid {
+		if _, err := parseInfoData(strings.NewReader(data)); err == nil {
+			t.Errorf("invalid security profile accepted: %s\n", data)
+		}
+	}
+}
+
+func TestSecuritySpec(t *testing.T) {
+	noNewPrivileges := false
+	profile := SecurityProfile{
+		Seccomp:         SeccompUnconfined,
+		ReadOnlyRootfs:  true,
+		Tmpfs:           []Tmpfs{{Target: "/tmp", Size: "1m"}},
+		NoNewPrivileges: &noNewPrivileges,
+		User:            "1000",
+		MaskedPaths:     []string{"/proc/secret"},
+	}
+
+	spec := &oci.Spec{
+		Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{}},
+		Root:    &specs.Root{},
+		Linux:   &specs.Linux{},
+	}
+
+	for _, opt := range profile.specOpts() {
+		if err := opt(context.Background(), nil, &containers.Container{}, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(spec.Process.Capabilities.Bounding, defaultCapabilities) {
+		t.Errorf("want %v got %v\n", defaultCapabilities, spec.Process.Capabilities.Bounding)
+	}
+
+	if spec.Process.NoNewPrivileges || !spec.Root.Readonly {
+		t.Errorf("want privileges kept and read-only root got %v/%v\n",
+			spec.Process.NoNewPrivileges, spec.Root.Readonly)
+	}
+
+	if spec.Process.User.UID != 1000 || spec.Process.User.GID != 1000 {
+		t.Errorf("want 1000:1000 got %d:%d\n", spec.Process.User.UID, spec.Process.User.GID)
+	}
+
+	if len(spec.Mounts) != 1 || spec.Mounts[0].Type != "tmpfs" {
+		t.Errorf("want a tmpfs mount got %v\n", spec.Mounts)
+	}
+
+	if spec.Linux.Seccomp != nil {
+		t.Errorf("want no seccomp got %v\n", spec.Linux.Seccomp)
+	}
+
+	if !reflect.DeepEqual(spec.Linux.MaskedPaths, profile.MaskedPaths) {
+		t.Errorf("want %v got %v\n", profile.MaskedPaths, spec.Linux.MaskedPaths)
+	}
+}
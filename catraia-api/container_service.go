@@ -4,33 +4,114 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
 )
 
+// Info is the runtime state of a service task. Metrics is absent when the
+// task is not running and UserNamespace when the service runs as the ids of
+// the host.
 type Info struct {
-	ID        string
-	Timestamp time.Time
-	Data      interface{}
+	ID            string            `json:"id"`
+	State         string            `json:"state"`
+	Pid           uint32            `json:"pid"`
+	ExitCode      *uint32           `json:"exit_code,omitempty"`
+	StartedAt     *time.Time        `json:"started_at,omitempty"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	Restarts      int               `json:"restarts"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Metrics       *ContainerMetrics `json:"metrics,omitempty"`
+	UserNamespace *IDMapping        `json:"user_namespace,omitempty"`
 }
 
+// Service states reported by List
+const (
+	StateNotCreated = "not created"
+	StateCreated    = "created"
+	StateRunning    = "running"
+	StatePaused     = "paused"
+	StateStopped    = "stopped"
+	StateCrashLoop  = "crash-looping"
+	StateUnknown    = "unknown"
+)
+
+type ServiceStatus struct {
+	ID        string  `json:"id"`
+	State     string  `json:"state"`
+	ExitCode  *uint32 `json:"exit_code,omitempty"`
+	Ref       string  `json:"ref"`
+	Container string  `json:"container,omitempty"`
+	Image     string  `json:"image,omitempty"`
+	Digest    string  `json:"digest,omitempty"`
+	Restarts  int     `json:"restarts"`
+	Endpoint  string  `json:"endpoint,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// DeployResult tells what a deploy changed. Container is one of created,
+// unchanged or recreated. RolledBack is set when the service was restored
+// to a known-good release, whose image digest is then reported.
+type DeployResult struct {
+	Container  string `json:"container"`
+	Digest     string `json:"digest,omitempty"`
+	RolledBack bool   `json:"rolled_back,omitempty"`
+
+	// failed tries to reach the registry or its mirrors
+	PullAttempts []PullAttempt `json:"pull_attempts,omitempty"`
+}
+
+// UndeployResult tells how the task of an undeployed service ended, if it
+// had one
+type UndeployResult struct {
+	Service string      `json:"service"`
+	Task    *StopResult `json:"task,omitempty"`
+}
+
+var errNoRelease = errors.New("no previous release to roll back to")
+
 type ContainerService interface {
-	Deploy(ctx context.Context, id string) error
-	Undeploy(ctx context.Context, id string) error
+	Deploy(ctx context.Context, id string, progress Progress) (*DeployResult, error)
+	Undeploy(ctx context.Context, id string) (*UndeployResult, error)
+	Rollback(ctx context.Context, id string, progress Progress) (*DeployResult, error)
 	Info(ctx context.Context, id string) (*Info, error)
+	List(ctx context.Context) ([]*ServiceStatus, error)
+	Logs(ctx context.Context, id string, opts LogOptions, w io.Writer) error
+	Exec(ctx context.Context, id string, opts ExecOptions,
+		stdin io.Reader, stdout, stderr io.Writer) (uint32, error)
+	Pause(ctx context.Context, id string) (*Info, error)
+	Resume(ctx context.Context, id string) (*Info, error)
+	Restart(ctx context.Context, id string) (*Info, error)
+	Signal(ctx context.Context, id string, sig syscall.Signal) (*Info, error)
+	Supervise(ctx context.Context)
 }
 
 type CreationListener interface {
 	Created(id string, pid uint32)
 }
 
+// EndpointRouter manages the proxy endpoints of services. Route points a
+// service to the endpoint of one of its containers, Pause and Resume turn
+// its requests away and back and Probe requests a path from a container
+// through the proxy.
+type EndpointRouter interface {
+	Endpoint(id string) (string, error)
+	Route(id, containerID string) error
+	Unroute(id string) error
+	Pause(id string) error
+	Resume(id string) error
+	Probe(ctx context.Context, containerID, path string) error
+}
+
 type ContainerdConfig struct {
 	Namespace string
 	Socket    string
@@ -39,64 +120,214 @@ type ContainerdConfig struct {
 type service struct {
 	conf          *ContainerdConfig
 	configService ImageInfoService
+	logs          *logStore
+	releases      *releaseStore
+	volumes       *volumeStore
+	secrets       *secretStore
+	userns        *usernsPool
+	registries    *RegistryConfig
+	router        EndpointRouter
 	listeners     []CreationListener
+	supervisor    *supervisor
+	locks         *serviceLocks
+}
+
+// serviceLocks serializes what changes the task of a service: deploys,
+// rollbacks, undeploys, controls and supervised restarts
+type serviceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
 }
 
-func NewContainerService(conf *ContainerdConfig, imageService ImageInfoService, listeners ...CreationListener) ContainerService {
-	return &service{conf, imageService, listeners}
+// lock takes the lock of service id, returning its release
+func (sl *serviceLocks) lock(id string) func() {
+	sl.mutex.Lock()
+	if sl.locks == nil {
+		sl.locks = make(map[string]*sync.Mutex)
+	}
+
+	m, ok := sl.locks[id]
+	if !ok {
+		m = &sync.Mutex{}
+		sl.locks[id] = m
+	}
+	sl.mutex.Unlock()
+
+	m.Lock()
+	return m.Unlock
 }
 
-func (c *service) Deploy(ctx context.Context, id string) error {
+func NewContainerService(conf *ContainerdConfig, imageService ImageInfoService,
+	logs *logStore, releases *releaseStore, volumes *volumeStore,
+	secrets *secretStore, userns *usernsPool, registries *RegistryConfig,
+	router EndpointRouter, listeners ...CreationListener) ContainerService {
+	c := &service{
+		conf:          conf,
+		configService: imageService,
+		logs:          logs,
+		releases:      releases,
+		volumes:       volumes,
+		secrets:       secrets,
+		userns:        userns,
+		registries:    registries,
+		router:        router,
+		listeners:     listeners,
+		locks:         &serviceLocks{},
+	}
+
+	c.supervisor = newSupervisor(conf, imageService, c.restartTask, c.locks)
+
+	return c
+}
+
+func (c *service) Deploy(ctx context.Context, id string,
+	progress Progress) (_ *DeployResult, errRet error) {
+	defer func(start time.Time) {
+		observe(deploysTotal, deployDuration, start, errRet, id)
+	}(time.Now())
+
+	defer c.locks.lock(id)()
+
 	log.Printf("Conneting to containerd\n")
 	client, err := containerd.New(c.conf.Socket)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer client.Close()
 
 	log.Printf("Getting image configuration\n")
 	imageInfo, err := c.configService.Get(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if imageInfo == nil {
-		return errors.New("image does not exist at image service")
+		return nil, errors.New("image does not exist at image service")
 	}
 
 	ctx = namespaces.WithNamespace(ctx, c.conf.Namespace)
 
 	log.Printf("Deployng %s...\n", imageInfo.ID)
 
-	if _, err := c.ensureTask(ctx, client, imageInfo); err != nil {
-		return err
+	// a redeploy starts with a clean restart history
+	c.supervisor.Unwatch(id)
+
+	image, attempts, err := ensureImage(ctx, client, c.registries, imageInfo, progress)
+	if err != nil {
+		result, err := c.restore(ctx, client, id, err)
+		if result == nil {
+			result = &DeployResult{}
+		}
+		result.PullAttempts = attempts
+		return result, err
 	}
 
-	log.Printf("Deploy done")
+	d, err := c.ensureTask(ctx, client, imageInfo, image, progress)
+	if err != nil {
+		return c.restore(ctx, client, id, err)
+	}
+	d.result.PullAttempts = attempts
 
-	return nil
+	c.finish(ctx, id, d, progress)
+	c.record(ctx, client, imageInfo, d)
+
+	log.Printf("Deploy done, container %s", d.result.Container)
+
+	return d.result, nil
+}
+
+// Rollback deploys the release that preceded the current one
+func (c *service) Rollback(ctx context.Context, id string,
+	progress Progress) (_ *DeployResult, errRet error) {
+	defer func(start time.Time) {
+		observe(rollbacksTotal, rollbackDuration, start, errRet, id)
+	}(time.Now())
+
+	defer c.locks.lock(id)()
+
+	release, ok := c.releases.Previous(id)
+	if !ok {
+		return nil, errNoRelease
+	}
+
+	log.Printf("Conneting to containerd\n")
+	client, err := containerd.New(c.conf.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, c.conf.Namespace)
+
+	log.Printf("Rolling back %s to %s...\n", id, release.Digest)
+
+	c.supervisor.Unwatch(id)
+
+	d, err := c.deployRelease(ctx, client, release, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	c.record(ctx, client, &release.Info, d)
+	d.result.RolledBack = true
+
+	log.Printf("Rollback done, container %s", d.result.Container)
+
+	return d.result, nil
 }
 
-func (c *service) Undeploy(ctx context.Context, id string) error {
+// finish supervises the task of a deployment and removes the generations
+// it replaced
+func (c *service) finish(ctx context.Context, id string, d *deployment, progress Progress) {
+	c.supervisor.Watch(id, d.container.ID(), d.task.Pid())
+
+	if len(d.stale) > 0 {
+		progress.Phase(PhaseDraining)
+		c.drain(ctx, id, d.stale, d.result.Container != ContainerUnchanged)
+	}
+
+	progress.Phase(PhaseReady)
+}
+
+func (c *service) Undeploy(ctx context.Context, id string) (_ *UndeployResult, errRet error) {
+	defer func(start time.Time) {
+		observe(undeploysTotal, undeployDuration, start, errRet, id)
+	}(time.Now())
+
+	defer c.locks.lock(id)()
+
 	log.Printf("Conneting to containerd\n")
 	client, err := containerd.New(c.conf.Socket)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer client.Close()
 
 	ctx = namespaces.WithNamespace(ctx, c.conf.Namespace)
 
-	container, err := client.LoadContainer(ctx, id)
+	container, err := loadActiveContainer(ctx, client, id)
 	if err != nil {
-		return fmt.Errorf("container %s not found: %v", id, err)
+		return nil, fmt.Errorf("container %s not found: %v", id, err)
 	}
 
-	if err := ensureTaskDelete(ctx, container); err != nil {
-		return err
+	c.supervisor.Unwatch(id)
+
+	stopped, err := ensureTaskDelete(ctx, container)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	c.unroute(id)
+
+	if err := c.logs.Close(id); err != nil {
+		log.Printf("Fail to close log of service %s: %v\n", id, err)
+	}
+
+	if err := c.secrets.clear(id); err != nil {
+		log.Printf("Fail to clear secrets of service %s: %v\n", id, err)
+	}
+
+	return &UndeployResult{Service: id, Task: stopped}, nil
 }
 
 func (c *service) Info(ctx context.Context, id string) (*Info, error) {
@@ -108,7 +339,7 @@ func (c *service) Info(ctx context.Context, id string) (*Info, error) {
 	defer client.Close()
 
 	ctx = namespaces.WithNamespace(ctx, c.conf.Namespace)
-	container, err := client.LoadContainer(ctx, id)
+	container, err := loadActiveContainer(ctx, client, id)
 	if err != nil {
 		return nil, fmt.Errorf("container %s not found: %v", id, err)
 	}
@@ -118,38 +349,382 @@ func (c *service) Info(ctx context.Context, id string) (*Info, error) {
 		return nil, err
 	}
 
+	status, err := task.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		ID:        id,
+		State:     stateFromStatus(status.Status),
+		Pid:       task.Pid(),
+		Timestamp: time.Now(),
+	}
+
+	labels, err := container.Labels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if label, ok := labels[usernsLabel]; ok {
+		if info.UserNamespace, err = parseIDMapping(label); err != nil {
+			return nil, err
+		}
+	}
+
+	restarts, crashLooping := c.supervisor.Restarts(id)
+	info.Restarts = restarts
+	if crashLooping {
+		info.State = StateCrashLoop
+	}
+
+	if status.Status == containerd.Stopped {
+		exitCode := status.ExitStatus
+		info.ExitCode = &exitCode
+		return info, nil
+	}
+
+	if startedAt, err := processStartTime(task.Pid()); err == nil {
+		info.StartedAt = &startedAt
+		info.UptimeSeconds = int64(time.Since(startedAt) / time.Second)
+	}
+
 	metrics, err := task.Metrics(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Info{
-		ID:        metrics.ID,
-		Timestamp: metrics.Timestamp,
-		Data:      metrics.Data,
-	}, nil
+	info.Timestamp = metrics.Timestamp
+	if info.Metrics, err = decodeMetrics(metrics.Data); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (c *service) Logs(ctx context.Context, id string, opts LogOptions, w io.Writer) error {
+	return c.logs.Write(ctx, id, opts, w)
+}
+
+func (c *service) Supervise(ctx context.Context) {
+	c.supervisor.Run(ctx)
+}
+
+// restartTask replaces the stopped task of a service by a new one,
+// returning the container it runs on
+func (c *service) restartTask(ctx context.Context, id string) (string, uint32, error) {
+	client, err := containerd.New(c.conf.Socket)
+	if err != nil {
+		return "", 0, err
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, c.conf.Namespace)
+
+	container, err := loadActiveContainer(ctx, client, id)
+	if err != nil {
+		return "", 0, fmt.Errorf("container %s not found: %v", id, err)
+	}
+
+	task, err := c.replaceTask(ctx, id, container, noProgress{})
+	if err != nil {
+		return "", 0, err
+	}
+
+	return container.ID(), task.Pid(), nil
+}
+
+func (c *service) List(ctx context.Context) ([]*ServiceStatus, error) {
+	log.Printf("Conneting to containerd\n")
+	client, err := containerd.New(c.conf.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	imageInfos, err := c.configService.List()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = namespaces.WithNamespace(ctx, c.conf.Namespace)
+
+	statuses := make([]*ServiceStatus, 0, len(imageInfos))
+	for _, imageInfo := range imageInfos {
+		status := &ServiceStatus{
+			ID:  imageInfo.ID,
+			Ref: imageInfo.Ref,
+		}
+
+		if err := c.fillStatus(ctx, client, status); err != nil {
+			log.Printf("Fail to get status of service %s: %v\n", imageInfo.ID, err)
+			status.State = StateUnknown
+			status.Error = err.Error()
+		}
+
+		restarts, crashLooping := c.supervisor.Restarts(imageInfo.ID)
+		status.Restarts = restarts
+		if crashLooping {
+			status.State = StateCrashLoop
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func (c *service) fillStatus(ctx context.Context, client *containerd.Client,
+	status *ServiceStatus) error {
+
+	container, err := loadActiveContainer(ctx, client, status.ID)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			status.State = StateNotCreated
+			return nil
+		}
+
+		return err
+	}
+
+	status.Container = container.ID()
+
+	image, err := container.Image(ctx)
+	if err != nil {
+		return err
+	}
+
+	status.Image = image.Name()
+	status.Digest = image.Target().Digest.String()
+
+	if c.router != nil {
+		if endpoint, err := c.router.Endpoint(status.ID); err == nil {
+			status.Endpoint = endpoint
+		}
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			status.State = StateCreated
+			return nil
+		}
+
+		return err
+	}
+
+	taskStatus, err := task.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	status.State = stateFromStatus(taskStatus.Status)
+	if taskStatus.Status == containerd.Stopped {
+		exitCode := taskStatus.ExitStatus
+		status.ExitCode = &exitCode
+	}
+
+	return nil
+}
+
+func stateFromStatus(status containerd.ProcessStatus) string {
+	switch status {
+	case containerd.Created:
+		return StateCreated
+	case containerd.Running:
+		return StateRunning
+	case containerd.Paused, containerd.Pausing:
+		return StatePaused
+	case containerd.Stopped:
+		return StateStopped
+	default:
+		return StateUnknown
+	}
+}
+
+// deployment is the outcome of ensuring the task of a service: the
+// container serving it and the previous generations left to drain
+type deployment struct {
+	image     containerd.Image
+	hash      string
+	container containerd.Container
+	task      containerd.Task
+	stale     []containerd.Container
+	result    *DeployResult
 }
 
 func (c *service) ensureTask(ctx context.Context, client *containerd.Client,
-	imageInfo *ImageInfo) (task containerd.Task, err error) {
+	imageInfo *ImageInfo, image containerd.Image, progress Progress) (*deployment, error) {
+
+	generations, err := serviceGenerations(ctx, client, imageInfo.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyImage(ctx, client, c.registries, imageInfo, image); err != nil {
+		return nil, err
+	}
+
+	var mapping *IDMapping
+	if imageInfo.UserNamespace {
+		if mapping, err = c.userns.Allocate(imageInfo.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	mounts, err := c.volumes.mounts(imageInfo, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	secretMounts, secretEnv, secretDigests, err := c.secrets.inject(imageInfo, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	extra := []oci.SpecOpts{
+		oci.WithMounts(append(mounts, secretMounts...)),
+		oci.WithEnv(secretEnv),
+		oci.WithAnnotations(secretDigests),
+	}
+	if mapping != nil {
+		extra = append(extra, mapping.specOpts())
+	}
+
+	if err := imageInfo.Resources.checkCapacity(); err != nil {
+		return nil, err
+	}
+
+	number := nextGeneration(generations)
+	spec, hash, err := generateSpec(ctx, client, generationID(imageInfo.ID, number),
+		image, imageInfo, extra...)
+	if err != nil {
+		return nil, err
+	}
+
+	outcome := ContainerUnchanged
+	current := activeGeneration(generations)
+	if current != nil && !sameSpec(current, hash) {
+		updated, err := c.updateResources(ctx, imageInfo.ID, current, image, spec, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if updated {
+			outcome = ContainerUpdated
+			current.labels[specHashLabel] = hash
+		}
+	}
+
+	if sameSpec(current, hash) {
+		if _, err := current.container.SetLabels(ctx, stopLabels(imageInfo)); err != nil {
+			return nil, err
+		}
+
+		task, err := c.ensureCurrentTask(ctx, imageInfo.ID, current.container, progress)
+		if err != nil {
+			return nil, err
+		}
+
+		return &deployment{
+			image:     image,
+			hash:      hash,
+			container: current.container,
+			task:      task,
+			stale:     staleContainers(generations, current.container),
+			result: &DeployResult{
+				Container: outcome,
+				Digest:    image.Target().Digest.String(),
+			},
+		}, nil
+	}
+
+	result := &DeployResult{
+		Container: ContainerCreated,
+		Digest:    image.Target().Digest.String(),
+	}
+	if current != nil {
+		log.Printf("Spec of service %s changed, rolling out a new container\n", imageInfo.ID)
+		result.Container = ContainerRecreated
+	}
+
+	container, err := createContainer(ctx, client, imageInfo, number, image, spec, hash,
+		mapping, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	task, err := c.startGeneration(ctx, imageInfo, container, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deployment{
+		image:     image,
+		hash:      hash,
+		container: container,
+		task:      task,
+		stale:     staleContainers(generations, container),
+		result:    result,
+	}, nil
+}
 
-	container, err := ensureContainer(ctx, client, imageInfo)
+// ensureCurrentTask keeps the task of an unchanged container running,
+// replacing it if stopped
+func (c *service) ensureCurrentTask(ctx context.Context, id string,
+	container containerd.Container, progress Progress) (containerd.Task, error) {
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return c.replaceTask(ctx, id, container, progress)
+	}
+
+	status, err := task.Status(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	task, err = container.Task(ctx, nil)
+	if status.Status == containerd.Stopped {
+		log.Printf("Replacing stopped task of container %s\n", container.ID())
+		return c.replaceTask(ctx, id, container, progress)
+	}
+
+	return task, nil
+}
+
+// replaceTask creates a new task for the container serving a service. The
+// task gets a new address, so the service is routed to it again.
+func (c *service) replaceTask(ctx context.Context, id string,
+	container containerd.Container, progress Progress) (containerd.Task, error) {
+
+	if _, err := ensureTaskDelete(ctx, container); err != nil {
+		return nil, err
+	}
+
+	task, err := c.createTask(ctx, id, container, progress)
 	if err != nil {
-		return c.createTask(ctx, container)
+		return nil, err
+	}
+
+	if container.ID() != id {
+		if err := c.router.Route(id, container.ID()); err != nil {
+			return nil, err
+		}
 	}
 
 	return task, nil
 }
 
-func (c *service) createTask(ctx context.Context, container containerd.Container) (_ containerd.Task, errRet error) {
+func (c *service) createTask(ctx context.Context, id string, container containerd.Container,
+	progress Progress) (_ containerd.Task, errRet error) {
+
+	creator, err := c.logs.Creator(id)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Printf("Creating task for container %s\n", container.ID())
-	task, err := container.NewTask(ctx, cio.NewCreator(cio.WithStdio))
+	task, err := container.NewTask(ctx, creator)
 	if err != nil {
 		return nil, err
 	}
@@ -159,10 +734,12 @@ func (c *service) createTask(ctx context.Context, container containerd.Container
 		}
 	}()
 
+	progress.Phase(PhaseNetworking)
 	for _, l := range c.listeners {
 		l.Created(container.ID(), task.Pid())
 	}
 
+	progress.Phase(PhaseStarting)
 	log.Printf("Starting task for container %s\n", container.ID())
 	if err := task.Start(ctx); err != nil {
 		return nil, err
@@ -171,120 +748,199 @@ func (c *service) createTask(ctx context.Context, container containerd.Container
 	return task, nil
 }
 
-func ensureTaskDelete(ctx context.Context, container containerd.Container) error {
+func staleContainers(generations []*containerGeneration,
+	active containerd.Container) []containerd.Container {
+
+	var stale []containerd.Container
+	for _, generation := range generations {
+		if generation.container.ID() != active.ID() {
+			stale = append(stale, generation.container)
+		}
+	}
+
+	return stale
+}
+
+// ensureTaskDelete stops the task of a container, if any, and deletes it.
+// A task still running after being killed is left alone.
+func ensureTaskDelete(ctx context.Context, container containerd.Container) (*StopResult, error) {
 
 	task, err := container.Task(ctx, nil)
 	if err != nil {
 		if strings.Contains(err.Error(), "no running task found") {
-			return nil
+			return nil, nil
 		}
 
-		return err
+		return nil, err
 	}
 
 	status, err := task.Status(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer task.Delete(ctx)
-
-	if status.Status == containerd.Stopped {
-		return nil
+	result := &StopResult{
+		ExitCode: status.ExitStatus,
+		ExitedAt: status.ExitTime,
 	}
 
-	exitStatus, err := stopWaitTask(ctx, task)
-	if err != nil {
-		return err
+	if status.Status != containerd.Stopped {
+		sig, timeout, err := stopSettings(ctx, container)
+		if err != nil {
+			return nil, err
+		}
+
+		if result, err = stopWaitTask(ctx, task, sig, timeout); err != nil {
+			return nil, err
+		}
 	}
 
-	if exitStatus.Error() != nil {
-		log.Printf("Exit status of the task: %v\n", exitStatus.Error())
+	if _, err := task.Delete(ctx); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return result, nil
 }
 
-func stopWaitTask(ctx context.Context, task containerd.Task) (*containerd.ExitStatus, error) {
+// stopWaitTask sends sig to a task and waits for it to exit, killing it
+// when it is still running after timeout
+func stopWaitTask(ctx context.Context, task containerd.Task, sig syscall.Signal,
+	timeout time.Duration) (*StopResult, error) {
 
 	exitStatusChan, err := task.Wait(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := task.Kill(ctx, syscall.SIGTERM); err != nil {
+	// a frozen task would not handle the signal
+	if status, err := task.Status(ctx); err == nil && status.Status == containerd.Paused {
+		if err := task.Resume(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := task.Kill(ctx, sig); err != nil {
 		return nil, err
 	}
 
+	result := &StopResult{Signal: int(sig)}
+
+	var exitStatus containerd.ExitStatus
 	select {
-	case exitStatus := <-exitStatusChan:
-		return &exitStatus, nil
+	case exitStatus = <-exitStatusChan:
+	case <-time.After(timeout):
+		log.Printf("Task %s still running %v after signal %d, killing it\n",
+			task.ID(), timeout, sig)
+		result.Killed = true
+
+		if err := task.Kill(ctx, syscall.SIGKILL, containerd.WithKillAll); err != nil {
+			return nil, err
+		}
+
+		select {
+		case exitStatus = <-exitStatusChan:
+		case <-time.After(killTimeout):
+			return nil, fmt.Errorf("task %s did not exit once killed", task.ID())
+		case <-ctx.Done():
+			return nil, fmt.Errorf("done waiting task")
+		}
 	case <-ctx.Done():
 		return nil, fmt.Errorf("done waiting task")
 	}
-}
-
-func ensureContainer(ctx context.Context, client *containerd.Client,
-	imageInfo *ImageInfo) (containerd.Container, error) {
 
-	container, err := client.LoadContainer(ctx, imageInfo.ID)
-	if err != nil {
-		return createContainer(ctx, client, imageInfo)
-	}
-
-	image, err := container.Image(ctx)
+	code, exitedAt, err := exitStatus.Result()
 	if err != nil {
 		return nil, err
 	}
 
-	if image.Name() != imageInfo.Ref {
-		if err := deleteContainer(ctx, container); err != nil {
-			return nil, err
-		}
-
-		return createContainer(ctx, client, imageInfo)
-	}
+	result.ExitCode = code
+	result.ExitedAt = exitedAt
 
-	return container, nil
+	return result, nil
 }
 
-func createContainer(ctx context.Context, client *containerd.Client,
-	imageInfo *ImageInfo) (containerd.Container, error) {
+func createContainer(ctx context.Context, client *containerd.Client, imageInfo *ImageInfo,
+	number int, image containerd.Image, spec *oci.Spec, hash string,
+	mapping *IDMapping, progress Progress) (containerd.Container, error) {
 
-	image, err := ensureImage(ctx, client, imageInfo)
-	if err != nil {
-		return nil, err
+	id := generationID(imageInfo.ID, number)
+
+	labels := make(map[string]string, len(imageInfo.Labels)+4)
+	for key, value := range imageInfo.Labels {
+		labels[key] = value
+	}
+	labels[serviceLabel] = imageInfo.ID
+	labels[generationLabel] = strconv.Itoa(number)
+	labels[specHashLabel] = hash
+
+	// a remapped snapshot is owned by the root of the user namespace
+	snapshot := containerd.WithNewSnapshot(id+"-snapshot", image)
+	if mapping != nil {
+		snapshot = mapping.snapshotOpts(id+"-snapshot", image)
+		labels[usernsLabel] = mapping.String()
 	}
 
-	log.Printf("Creating container %s\n", imageInfo.ID)
-	return client.NewContainer(ctx, imageInfo.ID,
+	progress.Phase(PhaseCreating)
+	log.Printf("Creating container %s\n", id)
+	return client.NewContainer(ctx, id,
 		containerd.WithImage(image),
-		containerd.WithNewSnapshot(imageInfo.ID+"-snapshot", image),
-		containerd.WithNewSpec(oci.WithImageConfig(image),
-			oci.WithCapabilities([]string{"CAP_NET_RAW"})))
+		snapshot,
+		containerd.WithSpec(spec),
+		containerd.WithContainerLabels(labels),
+		withStopSettings(image, imageInfo))
 }
 
 func deleteContainer(ctx context.Context, container containerd.Container) error {
 
-	if err := ensureTaskDelete(ctx, container); err != nil {
+	if _, err := ensureTaskDelete(ctx, container); err != nil {
 		return err
 	}
 
 	return container.Delete(ctx, containerd.WithSnapshotCleanup)
 }
 
-func ensureImage(ctx context.Context, client *containerd.Client,
-	config *ImageInfo) (containerd.Image, error) {
+// ensureImage returns the image of a service, pulling it when missing or
+// when its tag moved
+func ensureImage(ctx context.Context, client *containerd.Client, registries *RegistryConfig,
+	config *ImageInfo, progress Progress) (containerd.Image, []PullAttempt, error) {
+
+	if config.Digest != "" {
+		return ensurePinnedImage(ctx, client, registries, config, progress)
+	}
 
 	image, err := client.GetImage(ctx, config.Ref)
 	if err != nil {
-		return pullImage(ctx, client, config.Ref)
+		return pullImage(ctx, client, registries, config.Ref, progress)
+	}
+
+	desc, attempts, err := resolveImage(ctx, registries, config.Ref)
+	if err != nil {
+		log.Printf("Fail to resolve %s, using local image: %v\n", config.Ref, err)
+		return image, attempts, nil
+	}
+
+	if desc.Digest != image.Target().Digest {
+		log.Printf("Image %s moved to %s\n", config.Ref, desc.Digest)
+		image, pulled, err := pullImage(ctx, client, registries, config.Ref, progress)
+		return image, append(attempts, pulled...), err
 	}
 
-	return image, nil
+	return image, attempts, nil
 }
 
-func pullImage(ctx context.Context, client *containerd.Client, ref string) (containerd.Image, error) {
-	log.Printf("Pulling image %s\n", ref)
-	return client.Pull(ctx, ref, containerd.WithPullUnpack)
+// ensurePinnedImage takes the image of a service at its pinned digest from
+// the local images, pulling it by digest only when none has it, so a tag
+// that moved on does not matter
+func ensurePinnedImage(ctx context.Context, client *containerd.Client, registries *RegistryConfig,
+	config *ImageInfo, progress Progress) (containerd.Image, []PullAttempt, error) {
+
+	for _, name := range []string{config.Ref, pinnedRef(config)} {
+		image, err := client.GetImage(ctx, name)
+		if err == nil && image.Target().Digest.String() == config.Digest {
+			return image, nil, nil
+		}
+	}
+
+	log.Printf("Pulling %s at its pinned digest %s\n", config.Ref, config.Digest)
+	return pullImage(ctx, client, registries, pinnedRef(config), progress)
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+)
+
+// label holding the hash of the spec and image a container was created with
+const specHashLabel = "io.catraia.spec-hash"
+
+// Results of ensuring a container on deploy
+const (
+	ContainerCreated   = "created"
+	ContainerUnchanged = "unchanged"
+	ContainerRecreated = "recreated"
+	ContainerUpdated   = "updated"
+)
+
+// specOpts returns the options building the OCI spec of a service
+func specOpts(image containerd.Image, imageInfo *ImageInfo,
+	extra ...oci.SpecOpts) []oci.SpecOpts {
+
+	opts := imageInfo.processOpts(image)
+	opts = append(opts, imageInfo.Security.specOpts()...)
+	opts = append(opts, imageInfo.Resources.specOpts()...)
+
+	return append(opts, extra...)
+}
+
+// generateSpec builds the effective spec of a service container and its
+// hash, which also covers the resolved image digest. Extra options apply
+// what is set up for the service on the host, as volumes and secrets.
+func generateSpec(ctx context.Context, client *containerd.Client, containerID string,
+	image containerd.Image, imageInfo *ImageInfo, extra ...oci.SpecOpts) (*oci.Spec, string, error) {
+
+	spec, err := oci.GenerateSpec(ctx, client,
+		&containers.Container{ID: containerID}, specOpts(image, imageInfo, extra...)...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := specHash(spec, image)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return spec, hash, nil
+}
+
+// sameSpec tells whether the active container of a service was created
+// with the spec and image of hash, so that deploying it changes nothing
+func sameSpec(current *containerGeneration, hash string) bool {
+	return current != nil && current.labels[specHashLabel] == hash
+}
+
+// specHash leaves out the cgroups path, which is derived from the container
+// id and so differs between generations of the same spec
+func specHash(spec *oci.Spec, image containerd.Image) (string, error) {
+	normalized := *spec
+	if spec.Linux != nil {
+		linux := *spec.Linux
+		linux.CgroupsPath = ""
+		normalized.Linux = &linux
+	}
+
+	data, err := json.Marshal(&normalized)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(data)
+	hash.Write([]byte(image.Target().Digest.String()))
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
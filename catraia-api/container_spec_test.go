@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+type digestImage struct {
+	containerd.Image
+
+	digest string
+}
+
+func (i *digestImage) Target() ocispec.Descriptor {
+	return ocispec.Descriptor{Digest: digest.FromString(i.digest)}
+}
+
+func TestSpecHash(t *testing.T) {
+	image := &digestImage{digest: "one"}
+
+	base := func() *oci.Spec {
+		return &oci.Spec{
+			Process: &specs.Process{Args: []string{"/helloweb"}, Env: []string{"PORT=80"}},
+			Linux:   &specs.Linux{CgroupsPath: "/default/helloweb-g1"},
+		}
+	}
+
+	baseHash, err := specHash(base(), image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		change func(*oci.Spec)
+		image  containerd.Image
+		same   bool
+	}{
+		{"unchanged", func(*oci.Spec) {}, image, true},
+		{"cgroups path", func(s *oci.Spec) { s.Linux.CgroupsPath = "/default/helloweb-g2" }, image, true},
+		{"image digest", func(*oci.Spec) {}, &digestImage{digest: "two"}, false},
+		{"args", func(s *oci.Spec) { s.Process.Args = []string{"/helloweb", "-v"} }, image, false},
+		{"env", func(s *oci.Spec) { s.Process.Env = []string{"PORT=8080"} }, image, false},
+		{"hostname", func(s *oci.Spec) { s.Hostname = "helloweb" }, image, false},
+		{"resources", func(s *oci.Spec) { s.Linux.Resources = &specs.LinuxResources{} }, image, false},
+	}
+
+	for _, c := range cases {
+		spec := base()
+		c.change(spec)
+
+		hash, err := specHash(spec, c.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (hash == baseHash) != c.same {
+			t.Errorf("%s: want same hash %v got %v\n", c.name, c.same, hash == baseHash)
+		}
+
+		current := &containerGeneration{labels: map[string]string{specHashLabel: baseHash}}
+		if sameSpec(current, hash) != c.same {
+			t.Errorf("%s: want container kept %v got %v\n", c.name, c.same, !c.same)
+		}
+	}
+
+	if sameSpec(nil, baseHash) {
+		t.Error("want a container created for a service without one")
+	}
+}
+
+func TestSpecHashGenerations(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	image := &digestImage{digest: "one"}
+	info := &ImageInfo{ID: "helloweb", Resources: Resources{Memory: "64m"}}
+
+	var hashes []string
+	for _, number := range []int{1, 2} {
+		container := &containers.Container{ID: generationID(info.ID, number)}
+
+		opts := append(info.Security.specOpts(), info.Resources.specOpts()...)
+		spec, err := oci.GenerateSpec(ctx, nil, container, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := specHash(spec, image)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	if hashes[0] != hashes[1] {
+		t.Errorf("want the same hash for both generations got %s and %s\n", hashes[0], hashes[1])
+	}
+}
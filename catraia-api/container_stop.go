@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+)
+
+// seconds a task has to exit on its stop signal, unless configured
+const defaultStopTimeout = 10
+
+// time a task has to exit once killed before giving up on it
+const killTimeout = 10 * time.Second
+
+// holds the seconds given to a container to stop before it is killed
+const stopTimeoutLabel = "io.catraia.stop-timeout"
+
+// holds the stop signal of the service info, empty for the one of the image
+// kept by containerd under its own stop signal label
+const stopSignalLabel = "io.catraia.stop-signal"
+
+// StopResult is how the task of a service ended. Killed tells the task
+// ignored its stop signal and was killed after the stop timeout.
+type StopResult struct {
+	ExitCode uint32    `json:"exit_code"`
+	ExitedAt time.Time `json:"exited_at"`
+	Signal   int       `json:"signal,omitempty"`
+	Killed   bool      `json:"killed"`
+}
+
+// withStopSettings labels a container with how to stop it: the stop signal
+// of the image, the one of the service info and the stop timeout
+func withStopSettings(image containerd.Image, info *ImageInfo) containerd.NewContainerOpts {
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container) error {
+		if err := containerd.WithImageStopSignal(image, "SIGTERM")(ctx, client, c); err != nil {
+			return err
+		}
+
+		for key, value := range stopLabels(info) {
+			c.Labels[key] = value
+		}
+
+		return nil
+	}
+}
+
+// stopLabels holds the stop settings of a service info, updated on
+// containers kept by a deploy. The stop signal label is always set, so one
+// removed from the info goes back to the image default.
+func stopLabels(info *ImageInfo) map[string]string {
+	return map[string]string{
+		stopSignalLabel:  info.StopSignal,
+		stopTimeoutLabel: strconv.Itoa(info.StopTimeout),
+	}
+}
+
+// stopSettings reads how to stop a container, defaulting to the stop signal
+// of the image, or SIGTERM, and defaultStopTimeout for containers created
+// without them
+func stopSettings(ctx context.Context, container containerd.Container) (syscall.Signal, time.Duration, error) {
+	labels, err := container.Labels(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var sig syscall.Signal
+	if value := labels[stopSignalLabel]; value != "" {
+		if sig, err = containerd.ParseSignal(value); err != nil {
+			return 0, 0, fmt.Errorf("invalid stop signal %q: %v", value, err)
+		}
+	} else if sig, err = containerd.GetStopSignal(ctx, container, syscall.SIGTERM); err != nil {
+		return 0, 0, err
+	}
+
+	timeout := defaultStopTimeout
+	if value, ok := labels[stopTimeoutLabel]; ok {
+		if timeout, err = strconv.Atoi(value); err != nil {
+			return 0, 0, fmt.Errorf("invalid stop timeout %q: %v", value, err)
+		}
+	}
+
+	return sig, time.Duration(timeout) * time.Second, nil
+}
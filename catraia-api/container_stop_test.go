@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+type labeledContainer struct {
+	containerd.Container
+	labels map[string]string
+}
+
+func (c *labeledContainer) Labels(ctx context.Context) (map[string]string, error) {
+	return c.labels, nil
+}
+
+func TestStopSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   string
+		info    ImageInfo
+		signal  syscall.Signal
+		timeout time.Duration
+	}{
+		{"info signal", "SIGQUIT", ImageInfo{StopSignal: "SIGINT", StopTimeout: 5}, syscall.SIGINT, 5 * time.Second},
+		{"signal removed", "SIGQUIT", ImageInfo{StopTimeout: 5}, syscall.SIGQUIT, 5 * time.Second},
+		{"no image signal", "", ImageInfo{StopTimeout: 30}, syscall.SIGTERM, 30 * time.Second},
+	}
+
+	for _, test := range tests {
+		labels := map[string]string{}
+		if test.image != "" {
+			labels[containerd.StopSignalLabel] = test.image
+		}
+
+		// a previous deploy set a signal that is now gone from the info
+		labels[stopSignalLabel] = "SIGUSR1"
+		for key, value := range stopLabels(&test.info) {
+			labels[key] = value
+		}
+
+		sig, timeout, err := stopSettings(context.Background(), &labeledContainer{labels: labels})
+		if err != nil {
+			t.Fatalf("%s: %v\n", test.name, err)
+		}
+
+		if sig != test.signal || timeout != test.timeout {
+			t.Errorf("%s: want %v after %v got %v after %v\n",
+				test.name, test.signal, test.timeout, sig, timeout)
+		}
+	}
+
+	sig, timeout, err := stopSettings(context.Background(), &labeledContainer{labels: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sig != syscall.SIGTERM || timeout != defaultStopTimeout*time.Second {
+		t.Errorf("want defaults got %v after %v\n", sig, timeout)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Stream types of exec frames
+const (
+	execStdout     = 1
+	execStderr     = 2
+	execExitStream = 3
+)
+
+const (
+	execContentType = "application/vnd.catraia.exec-stream"
+
+	// exec requests only carry options
+	maxExecRequestSize = 64 * 1024
+)
+
+// execExit is the payload of the last frame of an exec
+type execExit struct {
+	ExitCode *uint32 `json:"exit_code,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// execMux frames the streams of an exec over a single connection. The
+// first failed write tells the client is gone.
+type execMux struct {
+	mutex sync.Mutex
+	w     *bufio.Writer
+	err   error
+	gone  func()
+}
+
+func (m *execMux) stream(typ byte) io.Writer {
+	return &execStreamWriter{m, typ}
+}
+
+func (m *execMux) write(typ byte, p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	header := make([]byte, 8)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+
+	if _, m.err = m.w.Write(header); m.err == nil {
+		if _, m.err = m.w.Write(p); m.err == nil {
+			m.err = m.w.Flush()
+		}
+	}
+
+	if m.err != nil {
+		m.gone()
+		return 0, m.err
+	}
+
+	return len(p), nil
+}
+
+type execStreamWriter struct {
+	mux *execMux
+	typ byte
+}
+
+func (sw *execStreamWriter) Write(p []byte) (int, error) {
+	return sw.mux.write(sw.typ, p)
+}
+
+// execInput reads the stdin of an exec. End of file is the client closing
+// its side of the connection, any other error means it is gone.
+type execInput struct {
+	r    io.Reader
+	gone func()
+}
+
+func (in *execInput) Read(p []byte) (int, error) {
+	n, err := in.r.Read(p)
+	if err != nil && err != io.EOF {
+		in.gone()
+	}
+
+	return n, err
+}
+
+// watchClosed calls gone once the connection of an exec without stdin
+// fails, discarding anything the client sends meanwhile. End of file is the
+// client closing its side while it still reads the output.
+func watchClosed(r io.Reader, gone func()) {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		gone()
+	}
+}
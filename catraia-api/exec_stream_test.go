@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestExecMux(t *testing.T) {
+	var buf bytes.Buffer
+	mux := &execMux{w: bufio.NewWriter(&buf), gone: func() {}}
+
+	io.WriteString(mux.stream(execStdout), "hello")
+	io.WriteString(mux.stream(execStderr), "oops")
+
+	want := []struct {
+		typ     byte
+		payload string
+	}{
+		{execStdout, "hello"},
+		{execStderr, "oops"},
+	}
+
+	for _, w := range want {
+		header := buf.Next(8)
+		if header[0] != w.typ {
+			t.Errorf("want stream %d got %d\n", w.typ, header[0])
+		}
+
+		size := binary.BigEndian.Uint32(header[4:])
+		if payload := string(buf.Next(int(size))); payload != w.payload {
+			t.Errorf("want %q got %q\n", w.payload, payload)
+		}
+	}
+
+	gone := false
+	mux = &execMux{w: bufio.NewWriter(failingWriter{}), gone: func() { gone = true }}
+	if _, err := mux.stream(execStdout).Write([]byte("lost")); err == nil {
+		t.Errorf("want write error\n")
+	}
+
+	if !gone {
+		t.Errorf("want client gone after failed write\n")
+	}
+}
+
+type execContainers struct {
+	ContainerService
+}
+
+func (execContainers) Exec(ctx context.Context, id string, opts ExecOptions,
+	stdin io.Reader, stdout, stderr io.Writer) (uint32, error) {
+
+	// output comes after the client closed its side
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	io.WriteString(stdout, "hello")
+	return 0, nil
+}
+
+func TestExecHalfClose(t *testing.T) {
+	server := httptest.NewServer(newServiceHandler(execContainers{}, nil))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	body := `{"args":["date"]}`
+	fmt.Fprintf(conn, "POST /service/helloweb/exec HTTP/1.1\r\nHost: catraia\r\n"+
+		"Content-Length: %d\r\n\r\n%s", len(body), body)
+
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want status %d got %d\n", http.StatusOK, resp.StatusCode)
+	}
+
+	frames := make(map[byte]string)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			t.Fatal(err)
+		}
+		frames[header[0]] += string(payload)
+	}
+
+	if frames[execStdout] != "hello" {
+		t.Errorf("want output %q got %q\n", "hello", frames[execStdout])
+	}
+
+	if frames[execExitStream] != `{"exit_code":0}` {
+		t.Errorf("want exit code 0 got %s\n", frames[execExitStream])
+	}
+}
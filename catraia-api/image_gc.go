@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+)
+
+// GCResult lists the images removed by a garbage collection and the
+// content space it freed
+type GCResult struct {
+	Removed        []string `json:"removed"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// DiskUsage is the space taken by images and by the writable snapshots of
+// the containers of each service
+type DiskUsage struct {
+	Images      []*ImageStatus      `json:"images"`
+	Services    []*ServiceDiskUsage `json:"services"`
+	ContentSize int64               `json:"content_size"`
+}
+
+type ServiceDiskUsage struct {
+	ID         string                `json:"id"`
+	Containers []*ContainerDiskUsage `json:"containers"`
+	Size       int64                 `json:"size"`
+}
+
+type ContainerDiskUsage struct {
+	ID       string `json:"id"`
+	Snapshot string `json:"snapshot"`
+	Size     int64  `json:"size"`
+	Inodes   int64  `json:"inodes"`
+}
+
+// Run collects garbage every interval until ctx is done
+func (is *imageService) Run(ctx context.Context) {
+	if is.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(is.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := is.GC(ctx)
+			if err != nil {
+				log.Printf("Fail to collect image garbage: %v\n", err)
+				continue
+			}
+
+			log.Printf("Image garbage collection removed %d images, %d bytes\n",
+				len(result.Removed), result.ReclaimedBytes)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// GC removes the images not protected, letting containerd drop their
+// content and snapshots
+func (is *imageService) GC(ctx context.Context) (*GCResult, error) {
+	client, err := containerd.New(is.conf.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, is.conf.Namespace)
+
+	all, err := client.ImageService().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	protected, err := is.protectedImages(ctx, client, all)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := contentSize(ctx, client.ContentStore())
+	if err != nil {
+		return nil, err
+	}
+
+	var garbage []string
+	for _, img := range all {
+		if !protected[img.Name] {
+			garbage = append(garbage, img.Name)
+		}
+	}
+
+	result := &GCResult{Removed: []string{}}
+	for i, name := range garbage {
+		var opts []images.DeleteOpt
+		if i == len(garbage)-1 {
+			// wait for containerd to collect the content of all of them
+			opts = append(opts, images.SynchronousDelete())
+		}
+
+		log.Printf("Removing image %s\n", name)
+		err := client.ImageService().Delete(ctx, name, opts...)
+		if err != nil && !errdefs.IsNotFound(err) {
+			log.Printf("Fail to remove image %s: %v\n", name, err)
+			continue
+		}
+
+		imagesRemovedTotal.Inc()
+		result.Removed = append(result.Removed, name)
+	}
+
+	after, err := contentSize(ctx, client.ContentStore())
+	if err != nil {
+		return nil, err
+	}
+
+	if before > after {
+		result.ReclaimedBytes = before - after
+	}
+
+	return result, nil
+}
+
+// List reports the images with their sizes and the snapshot usage of each
+// service
+func (is *imageService) List(ctx context.Context) (*DiskUsage, error) {
+	client, err := containerd.New(is.conf.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, is.conf.Namespace)
+
+	all, err := client.ImageService().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	protected, err := is.protectedImages(ctx, client, all)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &DiskUsage{
+		Images:   make([]*ImageStatus, 0, len(all)),
+		Services: []*ServiceDiskUsage{},
+	}
+
+	for _, img := range all {
+		size, err := containerd.NewImage(client, img).Size(ctx)
+		if err != nil {
+			log.Printf("Fail to get size of image %s: %v\n", img.Name, err)
+		}
+
+		usage.Images = append(usage.Images, &ImageStatus{
+			Name:      img.Name,
+			Digest:    img.Target.Digest.String(),
+			Size:      size,
+			CreatedAt: img.CreatedAt,
+			Protected: protected[img.Name],
+		})
+	}
+
+	sort.Slice(usage.Images, func(i, j int) bool {
+		return usage.Images[i].Name < usage.Images[j].Name
+	})
+
+	infos, err := is.infoService.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		serviceUsage, err := snapshotUsage(ctx, client, info.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		usage.Services = append(usage.Services, serviceUsage)
+	}
+
+	if usage.ContentSize, err = contentSize(ctx, client.ContentStore()); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// protectedImages names the images to keep: the ones referenced by service
+// info, releases or containers and the latest ones of each service
+func (is *imageService) protectedImages(ctx context.Context, client *containerd.Client,
+	all []images.Image) (map[string]bool, error) {
+
+	protected := make(map[string]bool)
+
+	infos, err := is.infoService.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		protected[info.Ref] = true
+		if info.Digest != "" {
+			protected[pinnedRef(info)] = true
+		}
+
+		if release, ok := is.releases.Current(info.ID); ok {
+			protected[release.Image] = true
+		}
+
+		if release, ok := is.releases.Previous(info.ID); ok {
+			protected[release.Image] = true
+		}
+
+		for _, name := range latestImages(all, info.Ref, is.keep) {
+			protected[name] = true
+		}
+	}
+
+	containers, err := client.Containers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, container := range containers {
+		info, err := container.Info(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		protected[info.Image] = true
+	}
+
+	// signatures go along with the images they sign
+	signatures := make(map[string]bool)
+	for _, img := range all {
+		if protected[img.Name] {
+			signatures[signatureRef(img.Name, img.Target.Digest)] = true
+		}
+	}
+
+	for name := range signatures {
+		protected[name] = true
+	}
+
+	return protected, nil
+}
+
+// latestImages returns the names of the n most recently updated images of
+// the repository of ref
+func latestImages(all []images.Image, ref string, n int) []string {
+	locator := imageLocator(ref)
+
+	var candidates []images.Image
+	for _, img := range all {
+		if imageLocator(img.Name) == locator {
+			candidates = append(candidates, img)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].UpdatedAt.After(candidates[j].UpdatedAt)
+	})
+
+	var names []string
+	for i := 0; i < len(candidates) && i < n; i++ {
+		names = append(names, candidates[i].Name)
+	}
+
+	return names
+}
+
+func imageLocator(name string) string {
+	spec, err := reference.Parse(name)
+	if err != nil {
+		return name
+	}
+
+	return spec.Locator
+}
+
+func snapshotUsage(ctx context.Context, client *containerd.Client,
+	id string) (*ServiceDiskUsage, error) {
+
+	generations, err := serviceGenerations(ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &ServiceDiskUsage{
+		ID:         id,
+		Containers: []*ContainerDiskUsage{},
+	}
+
+	for _, generation := range generations {
+		info, err := generation.container.Info(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshotUsage, err := client.SnapshotService(info.Snapshotter).Usage(ctx, info.SnapshotKey)
+		if err != nil {
+			log.Printf("Fail to get snapshot usage of container %s: %v\n", info.ID, err)
+			continue
+		}
+
+		usage.Containers = append(usage.Containers, &ContainerDiskUsage{
+			ID:       info.ID,
+			Snapshot: info.SnapshotKey,
+			Size:     snapshotUsage.Size,
+			Inodes:   snapshotUsage.Inodes,
+		})
+		usage.Size += snapshotUsage.Size
+	}
+
+	return usage, nil
+}
+
+// contentSize sums the size of the blobs in the content store
+func contentSize(ctx context.Context, store content.Store) (int64, error) {
+	var size int64
+	err := store.Walk(ctx, func(info content.Info) error {
+		size += info.Size
+		return nil
+	})
+
+	return size, err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/images"
+)
+
+func TestLatestImages(t *testing.T) {
+	now := time.Now()
+	all := []images.Image{
+		{Name: "docker.io/renatofq/helloweb:1", UpdatedAt: now.Add(-2 * time.Hour)},
+		{Name: "docker.io/renatofq/helloweb:2", UpdatedAt: now.Add(-time.Hour)},
+		{Name: "docker.io/renatofq/helloweb@sha256:3", UpdatedAt: now},
+		{Name: "docker.io/renatofq/other:latest", UpdatedAt: now},
+	}
+
+	result := latestImages(all, "docker.io/renatofq/helloweb:latest", 2)
+
+	expected := []string{"docker.io/renatofq/helloweb@sha256:3", "docker.io/renatofq/helloweb:2"}
+	if len(result) != len(expected) {
+		t.Fatalf("want %v got %v\n", expected, result)
+	}
+
+	for i, name := range expected {
+		if result[i] != name {
+			t.Errorf("at %d want %s got %s\n", i, name, result[i])
+		}
+	}
+
+	if result := latestImages(all, "docker.io/renatofq/helloweb:latest", 0); len(result) != 0 {
+		t.Errorf("want no image got %v\n", result)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/renatofq/catraia/handlers"
+)
+
+type imageHandler struct {
+	imageService ImageService
+}
+
+func newImageHandler(imageService ImageService) http.Handler {
+	return &imageHandler{imageService}
+}
+
+func (s *imageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/images", "/images/":
+	case "/images/gc":
+		s.serveGC(w, r)
+		return
+	default:
+		handlers.WriteError(w, http.StatusNotFound, errors.New("unknown image resource"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		s.optionsImages(w, r)
+	case http.MethodGet:
+		s.getImages(w, r)
+	case http.MethodPost:
+		s.postImages(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *imageHandler) optionsImages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, GET, POST")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *imageHandler) getImages(w http.ResponseWriter, r *http.Request) {
+
+	usage, err := s.imageService.List(r.Context())
+	if err != nil {
+		log.Printf("Fail to list images: %v\n", err)
+		handlers.WriteError(w, http.StatusInternalServerError,
+			errors.New("fail to list images"))
+		return
+	}
+
+	handlers.WriteEntity(w, http.StatusOK, usage)
+}
+
+func (s *imageHandler) serveGC(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, POST")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPost:
+		s.postGC(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *imageHandler) postGC(w http.ResponseWriter, r *http.Request) {
+
+	result, err := s.imageService.GC(r.Context())
+	if err != nil {
+		log.Printf("Fail to collect image garbage: %v\n", err)
+		handlers.WriteError(w, http.StatusInternalServerError,
+			errors.New("fail to collect image garbage"))
+		return
+	}
+
+	handlers.WriteEntity(w, http.StatusOK, result)
+}
+
+// postImages imports the image archive sent as request body. The optional
+// ref query parameter names the imported image.
+func (s *imageHandler) postImages(w http.ResponseWriter, r *http.Request) {
+
+	statuses, err := s.imageService.Import(r.Context(), r.Body, r.URL.Query().Get("ref"))
+	if err != nil {
+		log.Printf("Fail to import image: %v\n", err)
+
+		switch err {
+		case errInvalidRef, errAmbiguousRef, errRefRequired, errEmptyArchive:
+			handlers.WriteError(w, http.StatusBadRequest, err)
+		default:
+			handlers.WriteError(w, http.StatusInternalServerError,
+				errors.New("fail to import image"))
+		}
+		return
+	}
+
+	handlers.WriteEntity(w, http.StatusCreated, statuses)
+}
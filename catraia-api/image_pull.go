@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// interval between samples of the pull progress
+const pullTrackInterval = 200 * time.Millisecond
+
+// pullImage pulls and unpacks an image, trying the mirrors of its
+// registry before the registry itself. The failed attempts are returned
+// whether the pull succeeds or not.
+func pullImage(ctx context.Context, client *containerd.Client, registries *RegistryConfig,
+	ref string, progress Progress) (_ containerd.Image, _ []PullAttempt, errRet error) {
+
+	defer func(start time.Time) {
+		observe(imagePullsTotal, imagePullDuration, start, errRet)
+	}(time.Now())
+
+	var image containerd.Image
+	attempts, err := registries.withFallback(ctx, ref, registries.attempts(),
+		func(resolver remotes.Resolver) error {
+			var err error
+			image, err = fetchImage(ctx, client, resolver, ref, progress)
+			return err
+		})
+	if err != nil {
+		return nil, attempts, err
+	}
+
+	log.Printf("Unpacking image %s\n", ref)
+	progress.Phase(PhaseUnpacking)
+	if err := image.Unpack(ctx, ""); err != nil {
+		return nil, attempts, err
+	}
+
+	return image, attempts, nil
+}
+
+func fetchImage(ctx context.Context, client *containerd.Client, resolver remotes.Resolver,
+	ref string, progress Progress) (containerd.Image, error) {
+
+	log.Printf("Pulling image %s\n", ref)
+	progress.Phase(PhasePulling)
+
+	jobs := &pullJobs{}
+	handler := images.HandlerFunc(func(ctx context.Context,
+		desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+
+		jobs.add(desc)
+		return nil, nil
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		trackPull(ctx, client.ContentStore(), jobs, progress, stop)
+	}()
+
+	image, err := client.Pull(ctx, ref, containerd.WithResolver(resolver),
+		containerd.WithImageHandler(handler))
+	close(stop)
+	<-done
+
+	return image, err
+}
+
+// resolveImage finds the descriptor a reference currently points to at its
+// registry. Each endpoint is tried once, as a local image can be used
+// when none answers.
+func resolveImage(ctx context.Context, registries *RegistryConfig,
+	ref string) (ocispec.Descriptor, []PullAttempt, error) {
+
+	var desc ocispec.Descriptor
+	attempts, err := registries.withFallback(ctx, ref, 1,
+		func(resolver remotes.Resolver) error {
+			var err error
+			_, desc, err = resolver.Resolve(ctx, ref)
+			return err
+		})
+
+	return desc, attempts, err
+}
+
+// pullJobs records the descriptors fetched by a pull
+type pullJobs struct {
+	mutex       sync.Mutex
+	descriptors []ocispec.Descriptor
+	seen        map[string]bool
+}
+
+func (j *pullJobs) add(desc ocispec.Descriptor) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.seen == nil {
+		j.seen = make(map[string]bool)
+	}
+
+	if j.seen[desc.Digest.String()] {
+		return
+	}
+
+	j.seen[desc.Digest.String()] = true
+	j.descriptors = append(j.descriptors, desc)
+}
+
+func (j *pullJobs) list() []ocispec.Descriptor {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return append([]ocispec.Descriptor(nil), j.descriptors...)
+}
+
+// trackPull reports the bytes fetched so far until stop is closed, taking
+// the active ingests from the content store and the size of the
+// descriptors already stored
+func trackPull(ctx context.Context, store content.Store, jobs *pullJobs,
+	progress Progress, stop <-chan struct{}) {
+
+	ticker := time.NewTicker(pullTrackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			reportPull(ctx, store, jobs.list(), progress)
+			return
+		}
+
+		reportPull(ctx, store, jobs.list(), progress)
+	}
+}
+
+// reportPull sends the bytes fetched of every descriptor of the pull and
+// the state of each image layer
+func reportPull(ctx context.Context, store content.Store,
+	descriptors []ocispec.Descriptor, progress Progress) {
+
+	blobs, err := blobProgress(ctx, store, descriptors)
+	if err != nil {
+		return
+	}
+
+	var pulled, total int64
+	layers := []LayerProgress{}
+	for i, blob := range blobs {
+		pulled += blob.Downloaded
+		total += blob.Total
+
+		if images.IsLayerType(descriptors[i].MediaType) {
+			layers = append(layers, blob)
+		}
+	}
+
+	progress.Pulled(pulled, total, layers)
+}
+
+func blobProgress(ctx context.Context, store content.Store,
+	descriptors []ocispec.Descriptor) ([]LayerProgress, error) {
+
+	statuses, err := store.ListStatuses(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	active := make(map[string]content.Status, len(statuses))
+	for _, status := range statuses {
+		active[status.Ref] = status
+	}
+
+	blobs := make([]LayerProgress, 0, len(descriptors))
+	for _, desc := range descriptors {
+		blob := LayerProgress{
+			Digest: desc.Digest.String(),
+			Total:  desc.Size,
+			Status: LayerWaiting,
+		}
+
+		if status, ok := active[remotes.MakeRefKey(ctx, desc)]; ok {
+			blob.Downloaded = status.Offset
+			blob.Status = LayerDownloading
+		} else if _, err := store.Info(ctx, desc.Digest); err == nil {
+			blob.Downloaded = desc.Size
+			blob.Status = LayerDone
+		}
+
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	errInvalidRef   = errors.New("invalid image ref")
+	errAmbiguousRef = errors.New("archive holds several images, ref is ambiguous")
+	errRefRequired  = errors.New("archive names images by tag only, a ref is required")
+	errEmptyArchive = errors.New("archive holds no image")
+)
+
+// ImageStatus describes an image known to containerd. Size is the size of
+// its content for the host platform. Protected images are kept by the
+// garbage collector.
+type ImageStatus struct {
+	Name      string    `json:"name"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	Protected bool      `json:"protected"`
+}
+
+// ImageService manages the images available to services: importing them
+// without a registry and removing the ones no longer needed
+type ImageService interface {
+	Import(ctx context.Context, r io.Reader, ref string) ([]*ImageStatus, error)
+	List(ctx context.Context) (*DiskUsage, error)
+	GC(ctx context.Context) (*GCResult, error)
+	Run(ctx context.Context)
+}
+
+type imageService struct {
+	conf        *ContainerdConfig
+	infoService ImageInfoService
+	releases    *releaseStore
+
+	// images of each service kept by the garbage collector besides the
+	// ones in use
+	keep int
+
+	// interval between scheduled garbage collections, none when zero
+	interval time.Duration
+}
+
+func NewImageService(conf *ContainerdConfig, infoService ImageInfoService,
+	releases *releaseStore, keep int, interval time.Duration) ImageService {
+
+	return &imageService{
+		conf:        conf,
+		infoService: infoService,
+		releases:    releases,
+		keep:        keep,
+		interval:    interval,
+	}
+}
+
+// Import loads an OCI image layout or docker save archive, optionally
+// gzipped, and unpacks its images. Images are named as in the archive or,
+// when ref is given, after ref, which then must match a single image.
+func (is *imageService) Import(ctx context.Context, r io.Reader,
+	ref string) ([]*ImageStatus, error) {
+
+	if ref != "" {
+		named, err := refdocker.ParseDockerRef(ref)
+		if err != nil {
+			log.Printf("Invalid image ref %s: %v\n", ref, err)
+			return nil, errInvalidRef
+		}
+
+		ref = named.String()
+	}
+
+	reader, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := containerd.New(is.conf.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, is.conf.Namespace)
+
+	log.Printf("Importing image archive\n")
+	imported, err := importArchive(ctx, client, reader, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*ImageStatus, 0, len(imported))
+	for _, img := range imported {
+		image := containerd.NewImage(client, img)
+
+		log.Printf("Unpacking image %s\n", img.Name)
+		if err := image.Unpack(ctx, ""); err != nil {
+			return nil, fmt.Errorf("fail to unpack %s: %v", img.Name, err)
+		}
+
+		size, err := image.Size(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		statuses = append(statuses, &ImageStatus{
+			Name:   img.Name,
+			Digest: img.Target.Digest.String(),
+			Size:   size,
+		})
+	}
+
+	return statuses, nil
+}
+
+// importArchive stores the content of an archive and names its images.
+// The index is validated before any image is created or moved.
+func importArchive(ctx context.Context, client *containerd.Client, reader io.Reader,
+	ref string) ([]images.Image, error) {
+
+	ctx, done, err := client.WithLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done(ctx)
+
+	store := client.ContentStore()
+
+	index, err := archive.ImportIndex(ctx, store, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := content.ReadBlob(ctx, store, index)
+	if err != nil {
+		return nil, err
+	}
+
+	var idx ocispec.Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, err
+	}
+
+	imported, err := archiveImages(idx.Manifests, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	// labels the content of the images, so it outlives the lease
+	handler := images.SetChildrenLabels(store,
+		images.FilterPlatforms(images.ChildrenHandler(store), platforms.Default()))
+	if err := images.Walk(ctx, handler, index); err != nil {
+		return nil, err
+	}
+
+	imageStore := client.ImageService()
+	for i := range imported {
+		img, err := imageStore.Update(ctx, imported[i], "target")
+		if errdefs.IsNotFound(err) {
+			img, err = imageStore.Create(ctx, imported[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		imported[i] = img
+	}
+
+	return imported, nil
+}
+
+// archiveImages names the manifests of an archive index: all after ref,
+// which then must match a single manifest, or as in the archive. OCI
+// layouts may name manifests by a bare tag, as latest, which is no image
+// name and so requires a ref.
+func archiveImages(manifests []ocispec.Descriptor, ref string) ([]images.Image, error) {
+	if len(manifests) == 0 {
+		return nil, errEmptyArchive
+	}
+
+	if ref != "" {
+		for _, m := range manifests[1:] {
+			if m.Digest != manifests[0].Digest {
+				return nil, errAmbiguousRef
+			}
+		}
+
+		return []images.Image{{Name: ref, Target: manifests[0]}}, nil
+	}
+
+	imported := make([]images.Image, 0, len(manifests))
+	for _, m := range manifests {
+		name := m.Annotations[images.AnnotationImageName]
+		if name == "" {
+			name = m.Annotations[ocispec.AnnotationRefName]
+			if name != "" && !strings.ContainsAny(name, "/:@") {
+				return nil, errRefRequired
+			}
+		}
+
+		if name != "" {
+			imported = append(imported, images.Image{Name: name, Target: m})
+		}
+	}
+
+	return imported, nil
+}
+
+// decompress unwraps gzipped archives, as produced by docker save | gzip
+func decompress(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+
+	magic, err := buffered.Peek(2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive: %v", err)
+	}
+
+	if magic[0] != 0x1f || magic[1] != 0x8b {
+		return buffered, nil
+	}
+
+	return gzip.NewReader(buffered)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDecompress(t *testing.T) {
+	data := []byte("archive data")
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	gz.Close()
+
+	for _, input := range [][]byte{data, compressed.Bytes()} {
+		reader, err := decompress(bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(result, data) {
+			t.Errorf("want %q got %q\n", data, result)
+		}
+	}
+}
+
+func TestArchiveImages(t *testing.T) {
+	ref := "docker.io/renatofq/helloweb:latest"
+	manifest := func(dgst, key, name string) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			Digest:      digest.Digest(dgst),
+			Annotations: map[string]string{key: name},
+		}
+	}
+
+	saved := []ocispec.Descriptor{
+		manifest("sha256:1", images.AnnotationImageName, "docker.io/renatofq/helloweb:1.0"),
+		manifest("sha256:1", images.AnnotationImageName, "docker.io/renatofq/helloweb:latest"),
+	}
+
+	named, err := archiveImages(saved, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(named) != 2 || named[0].Name != "docker.io/renatofq/helloweb:1.0" {
+		t.Errorf("want images named as in the archive got %v\n", named)
+	}
+
+	named, err = archiveImages(saved, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(named) != 1 || named[0].Name != ref || named[0].Target.Digest != "sha256:1" {
+		t.Errorf("want one image named %s got %v\n", ref, named)
+	}
+
+	several := append(saved, manifest("sha256:2", images.AnnotationImageName, "docker.io/renatofq/other:latest"))
+	if _, err := archiveImages(several, ref); err != errAmbiguousRef {
+		t.Errorf("want %v got %v\n", errAmbiguousRef, err)
+	}
+
+	layout := []ocispec.Descriptor{manifest("sha256:1", ocispec.AnnotationRefName, "latest")}
+	if _, err := archiveImages(layout, ""); err != errRefRequired {
+		t.Errorf("want %v got %v\n", errRefRequired, err)
+	}
+
+	if named, err := archiveImages(layout, ref); err != nil || named[0].Name != ref {
+		t.Errorf("want image named %s got %v: %v\n", ref, named, err)
+	}
+
+	if _, err := archiveImages(nil, ref); err != errEmptyArchive {
+		t.Errorf("want %v got %v\n", errEmptyArchive, err)
+	}
+}
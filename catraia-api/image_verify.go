@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Error codes of images refused to run
+const (
+	CodeDigestMismatch   = "digest_mismatch"
+	CodeSignatureMissing = "signature_missing"
+	CodeSignatureInvalid = "signature_invalid"
+)
+
+// cosign keeps the signature of each layer of a signature image here
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// VerificationError refuses an image that is not the one expected by its
+// service info. Code tells why to API clients.
+type VerificationError struct {
+	Code string
+	err  error
+}
+
+func (e *VerificationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *VerificationError) ErrorCode() string {
+	return e.Code
+}
+
+func verificationError(code, format string, a ...interface{}) error {
+	return &VerificationError{code, fmt.Errorf(format, a...)}
+}
+
+// simpleSigning is the payload signed by cosign
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifyImage checks an image against the digest pinned by its service
+// info and, when a public key is given, against a cosign signature stored
+// at its registry as <repository>:sha256-<hex>.sig
+func verifyImage(ctx context.Context, client *containerd.Client, registries *RegistryConfig,
+	info *ImageInfo, image containerd.Image) error {
+
+	dgst := image.Target().Digest
+	if info.Digest != "" && info.Digest != dgst.String() {
+		return verificationError(CodeDigestMismatch,
+			"image %s has digest %s, %s expected", info.Ref, dgst, info.Digest)
+	}
+
+	if info.PublicKey == "" {
+		return nil
+	}
+
+	key, err := readPublicKey(info.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	sigRef := signatureRef(image.Name(), dgst)
+	signatures, err := fetchSignatures(ctx, client, registries, sigRef)
+	if err != nil {
+		return verificationError(CodeSignatureMissing,
+			"no signature of image %s: %v", info.Ref, err)
+	}
+
+	for _, signature := range signatures {
+		if signature.verify(key, dgst.String()) {
+			return nil
+		}
+	}
+
+	return verificationError(CodeSignatureInvalid,
+		"no valid signature of image %s by %s", info.Ref, info.PublicKey)
+}
+
+type imageSignature struct {
+	payload   []byte
+	signature []byte
+}
+
+// verify tells whether the signature is of key over a payload naming the
+// manifest digest
+func (s *imageSignature) verify(key interface{}, digest string) bool {
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, s.payload, s.signature) {
+			return false
+		}
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(s.payload)
+		if !ecdsa.VerifyASN1(key, sum[:], s.signature) {
+			return false
+		}
+	default:
+		return false
+	}
+
+	var payload simpleSigning
+	if err := json.Unmarshal(s.payload, &payload); err != nil {
+		return false
+	}
+
+	return payload.Critical.Image.DockerManifestDigest == digest
+}
+
+// fetchSignatures reads the signatures of a cosign signature image,
+// fetched into the content store. A local copy is used when no registry
+// answers.
+func fetchSignatures(ctx context.Context, client *containerd.Client,
+	registries *RegistryConfig, sigRef string) ([]*imageSignature, error) {
+
+	var target ocispec.Descriptor
+	_, err := registries.withFallback(ctx, sigRef, 1, func(resolver remotes.Resolver) error {
+		img, err := client.Fetch(ctx, sigRef, containerd.WithResolver(resolver))
+		target = img.Target
+		return err
+	})
+	if err != nil {
+		log.Printf("Fail to fetch signature %s, looking for a local one: %v\n", sigRef, err)
+
+		image, localErr := client.GetImage(ctx, sigRef)
+		if localErr != nil {
+			return nil, err
+		}
+		target = image.Target()
+	}
+
+	store := client.ContentStore()
+	data, err := content.ReadBlob(ctx, store, target)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	var signatures []*imageSignature
+	for _, layer := range manifest.Layers {
+		encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			log.Printf("Invalid signature in %s: %v\n", sigRef, err)
+			continue
+		}
+
+		payload, err := content.ReadBlob(ctx, store, layer)
+		if err != nil {
+			return nil, err
+		}
+
+		signatures = append(signatures, &imageSignature{payload, signature})
+	}
+
+	if len(signatures) == 0 {
+		return nil, errors.New("signature image holds no signature")
+	}
+
+	return signatures, nil
+}
+
+// signatureRef names the cosign signature image of an image
+func signatureRef(name string, dgst digest.Digest) string {
+	return imageLocator(name) + ":" + strings.Replace(dgst.String(), ":", "-", 1) + ".sig"
+}
+
+// pinnedRef names the image of a service at its pinned digest, which a
+// pull resolves without looking up the tag
+func pinnedRef(info *ImageInfo) string {
+	ref := info.Ref
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+
+	return ref + "@" + info.Digest
+}
+
+// readPublicKey reads a PEM encoded ed25519 or ECDSA public key, as
+// written by cosign generate-key-pair
+func readPublicKey(path string) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %v", path, err)
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("public key %s is not ed25519 or ECDSA", path)
+	}
+}
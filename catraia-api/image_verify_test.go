@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const testManifestDigest = "sha256:6f2a3b6b9e1c1b8e2a1f0c7d4e5b6a7980a1b2c3d4e5f60718293a4b5c6d7e8f"
+
+func signingPayload(dgst string) []byte {
+	return []byte(`{"critical":{"identity":{"docker-reference":"registry.example.com/app"},` +
+		`"image":{"docker-manifest-digest":"` + dgst + `"},` +
+		`"type":"cosign container image signature"},"optional":null}`)
+}
+
+func writePublicKey(t *testing.T, dir string, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "cosign.pub")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestVerifySignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := readPublicKey(writePublicKey(t, dir, public))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := signingPayload(testManifestDigest)
+	signature := &imageSignature{payload, ed25519.Sign(private, payload)}
+
+	if !signature.verify(key, testManifestDigest) {
+		t.Errorf("want valid ed25519 signature\n")
+	}
+
+	// a valid signature of another image
+	other := signingPayload("sha256:" + digest.FromString("other").Hex())
+	if (&imageSignature{other, ed25519.Sign(private, other)}).verify(key, testManifestDigest) {
+		t.Errorf("want signature of another digest refused\n")
+	}
+
+	tampered := append([]byte{}, payload...)
+	tampered[0] = ' '
+	if (&imageSignature{tampered, signature.signature}).verify(key, testManifestDigest) {
+		t.Errorf("want tampered payload refused\n")
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err = readPublicKey(writePublicKey(t, dir, &ecKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(payload)
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecKey, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !(&imageSignature{payload, ecSignature}).verify(key, testManifestDigest) {
+		t.Errorf("want valid ECDSA signature\n")
+	}
+
+	if signature.verify(key, testManifestDigest) {
+		t.Errorf("want signature of another key refused\n")
+	}
+}
+
+func TestPinnedRef(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"registry.example.com/app:1.0", "registry.example.com/app:1.0@" + testManifestDigest},
+		{"registry.example.com/app@sha256:" + strings.Repeat("0", 64), "registry.example.com/app@" + testManifestDigest},
+	}
+
+	for _, test := range tests {
+		if ref := pinnedRef(&ImageInfo{Ref: test.ref, Digest: testManifestDigest}); ref != test.want {
+			t.Errorf("want %s got %s\n", test.want, ref)
+		}
+	}
+}
+
+func TestSignatureRef(t *testing.T) {
+	want := "registry.example.com/app:sha256-" + digest.Digest(testManifestDigest).Hex() + ".sig"
+	if ref := signatureRef("registry.example.com/app:1.0", testManifestDigest); ref != want {
+		t.Errorf("want %s got %s\n", want, ref)
+	}
+}
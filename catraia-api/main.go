@@ -3,27 +3,35 @@ package main
 import (
 	"context"
 	"log"
+	"path/filepath"
 	"sync"
 
 	"github.com/renatofq/catraia/config"
+	"github.com/renatofq/catraia/metrics"
 	"github.com/renatofq/catraia/servers"
 	"github.com/renatofq/catraia/utils"
 )
 
-func setupContainerService(conf *config.Config) ContainerService {
-	ctrdConf := &ContainerdConfig{
+func newContainerdConfig(conf *config.Config) *ContainerdConfig {
+	return &ContainerdConfig{
 		Namespace: conf.ContainerdNamespace,
 		Socket:    conf.ContainerdSocket,
 	}
+}
 
-	infoService, err := NewInfoService(conf.ImageInfoFile)
-	if err != nil {
-		return nil
-	}
+func setupContainerService(ctx context.Context, conf *config.Config,
+	infoService ImageInfoService, releases *releaseStore, volumes *volumeStore,
+	secrets *secretStore, userns *usernsPool, registries *RegistryConfig,
+	netListener NetListener) ContainerService {
+	ctrdConf := newContainerdConfig(conf)
 
-	eventListener := NewContainerListener(conf.NetServerAddr)
+	logs := newLogStore(conf.LogDir, conf.LogMaxSize, conf.LogMaxFiles)
 
-	return NewContainerService(ctrdConf, infoService, eventListener)
+	containerService := NewContainerService(ctrdConf, infoService, logs, releases,
+		volumes, secrets, userns, registries, netListener, netListener)
+	go containerService.Supervise(ctx)
+
+	return containerService
 }
 
 func setupTunnelServer(conf *config.Config) servers.Server {
@@ -33,10 +41,68 @@ func setupTunnelServer(conf *config.Config) servers.Server {
 	return tunnelServer
 }
 
-func setupAPIServer(conf *config.Config) servers.Server {
-	containerService := setupContainerService(conf)
+func setupAPIServer(ctx context.Context, conf *config.Config) servers.Server {
+	netListener := NewContainerListener(conf.NetServerAddr, conf.ProxyAddr)
+
+	infoService, err := NewInfoService(conf.ImageInfoFile)
+	if err != nil {
+		log.Fatalf("Fail to load image info: %v\n", err)
+	}
+
+	releases, err := newReleaseStore(filepath.Join(conf.StateDir, "releases.json"))
+	if err != nil {
+		log.Fatalf("Fail to load releases: %v\n", err)
+	}
+
+	registries, err := LoadRegistryConfig(conf.RegistryConfigFile)
+	if err != nil {
+		log.Fatalf("Fail to load registry config: %v\n", err)
+	}
+
+	volumes := newVolumeStore(conf.VolumeDir, newContainerdConfig(conf), infoService)
+
+	secrets := newSecretStore(filepath.Join(conf.StateDir, "secrets"),
+		filepath.Join(conf.StateDir, "secret.key"), filepath.Join(conf.RuntimeDir, "secrets"))
+
+	userns, err := newUsernsPool(filepath.Join(conf.StateDir, "userns.json"),
+		conf.UsernsBase, conf.UsernsSize, conf.UsernsRanges)
+	if err != nil {
+		log.Fatalf("Fail to load user namespace pool: %v\n", err)
+	}
+
+	infos, err := infoService.List()
+	if err != nil {
+		log.Fatalf("Fail to list services: %v\n", err)
+	}
+
+	ids := make([]string, 0, len(infos))
+	for _, info := range infos {
+		ids = append(ids, info.ID)
+	}
+
+	// ranges of services gone from the info are free for new ones
+	if err := userns.prune(ids); err != nil {
+		log.Fatalf("Fail to prune user namespace pool: %v\n", err)
+	}
+
+	containerService := setupContainerService(ctx, conf, infoService, releases,
+		volumes, secrets, userns, registries, netListener)
+
+	operationService := NewOperationService(containerService)
+	go operationService.Run(ctx)
+
+	metrics.Register(&containerCollector{containerService})
+
+	imageService := NewImageService(newContainerdConfig(conf), infoService, releases,
+		conf.ImageGCKeep, conf.ImageGCInterval)
+	go imageService.Run(ctx)
+
+	reconciler := NewReconciler(infoService, containerService, operationService,
+		conf.ReconcileInterval)
+	go reconciler.Run(ctx)
 
-	apiServer := NewAPIServer("API", conf.APIServerAddr, containerService)
+	apiServer := NewAPIServer("API", conf.APIServerAddr, containerService,
+		operationService, imageService, volumes, secrets, reconciler, netListener.Metrics)
 	go servers.Run(apiServer)
 
 	return apiServer
@@ -51,7 +117,7 @@ func main() {
 
 	tunnelServer := setupTunnelServer(conf)
 
-	apiServer := setupAPIServer(conf)
+	apiServer := setupAPIServer(ctx, conf)
 
 	log.Printf("catraia is ready\n")
 
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Deploy phases
+const (
+	PhasePending    = "pending"
+	PhasePulling    = "pulling"
+	PhaseUnpacking  = "unpacking"
+	PhaseCreating   = "creating"
+	PhaseNetworking = "networking"
+	PhaseStarting   = "starting"
+	PhaseChecking   = "checking"
+	PhaseDraining   = "draining"
+	PhaseReady      = "ready"
+	PhaseFailed     = "failed"
+
+	// restarts and undeploys, which go through no deploy phase
+	PhaseDone = "done"
+)
+
+const (
+	// deploys waiting for the worker before new ones are refused
+	operationQueueSize = 32
+
+	// finished operations kept for querying
+	maxFinishedOperations = 100
+)
+
+// Operation types
+const (
+	OperationDeploy   = "deploy"
+	OperationRollback = "rollback"
+	OperationRestart  = "restart"
+	OperationUndeploy = "undeploy"
+)
+
+var errQueueFull = errors.New("too many pending operations")
+
+// Layer states during a pull
+const (
+	LayerWaiting     = "waiting"
+	LayerDownloading = "downloading"
+	LayerDone        = "done"
+)
+
+// Progress receives the advance of a deploy. Pulled reports the bytes
+// fetched and known to fetch so far, with the state of each image layer.
+type Progress interface {
+	Phase(phase string)
+	Pulled(pulled, total int64, layers []LayerProgress)
+}
+
+type noProgress struct{}
+
+func (noProgress) Phase(string) {}
+
+func (noProgress) Pulled(int64, int64, []LayerProgress) {}
+
+type LayerProgress struct {
+	Digest     string `json:"digest"`
+	Downloaded int64  `json:"downloaded"`
+	Total      int64  `json:"total"`
+	Status     string `json:"status"`
+}
+
+type Operation struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Service     string          `json:"service"`
+	Phase       string          `json:"phase"`
+	BytesPulled int64           `json:"bytes_pulled"`
+	BytesTotal  int64           `json:"bytes_total"`
+	Layers      []LayerProgress `json:"layers,omitempty"`
+	Result      *DeployResult   `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	ErrorCode   string          `json:"error_code,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+// OperationService runs deploys, rollbacks, restarts and undeploys in
+// background, one at a time, keeping track of their progress
+type OperationService interface {
+	Deploy(id string) (*Operation, error)
+	Rollback(id string) (*Operation, error)
+	Restart(id string) (*Operation, error)
+	Undeploy(id string) (*Operation, error)
+	Get(id string) (*Operation, bool)
+	Latest(service string) (*Operation, bool)
+	Updates(ctx context.Context, id string) <-chan *Operation
+	Run(ctx context.Context)
+}
+
+type operationStore struct {
+	containerService ContainerService
+	queue            chan string
+
+	mutex      sync.Mutex
+	operations map[string]*Operation
+
+	// closed and replaced at every update of an operation
+	changed chan struct{}
+}
+
+func NewOperationService(containerService ContainerService) OperationService {
+	return &operationStore{
+		containerService: containerService,
+		queue:            make(chan string, operationQueueSize),
+		operations:       make(map[string]*Operation),
+		changed:          make(chan struct{}),
+	}
+}
+
+// Deploy queues the deploy of service id
+func (ops *operationStore) Deploy(id string) (*Operation, error) {
+	return ops.queueOperation(OperationDeploy, id)
+}
+
+// Rollback queues the rollback of service id to its previous release
+func (ops *operationStore) Rollback(id string) (*Operation, error) {
+	return ops.queueOperation(OperationRollback, id)
+}
+
+// Restart queues the restart of the task of service id
+func (ops *operationStore) Restart(id string) (*Operation, error) {
+	return ops.queueOperation(OperationRestart, id)
+}
+
+// Undeploy queues the undeploy of service id
+func (ops *operationStore) Undeploy(id string) (*Operation, error) {
+	return ops.queueOperation(OperationUndeploy, id)
+}
+
+func (ops *operationStore) queueOperation(typ, id string) (*Operation, error) {
+	op := &Operation{
+		ID:        uuid.New().String(),
+		Type:      typ,
+		Service:   id,
+		Phase:     PhasePending,
+		CreatedAt: time.Now(),
+	}
+
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+
+	select {
+	case ops.queue <- op.ID:
+	default:
+		return nil, errQueueFull
+	}
+
+	ops.operations[op.ID] = op
+	ops.prune()
+
+	snapshot := *op
+	return &snapshot, nil
+}
+
+// Get returns a snapshot of an operation
+func (ops *operationStore) Get(id string) (*Operation, bool) {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+
+	op, ok := ops.operations[id]
+	if !ok {
+		return nil, false
+	}
+
+	snapshot := *op
+	return &snapshot, true
+}
+
+// Latest returns a snapshot of the most recent operation of a service
+func (ops *operationStore) Latest(service string) (*Operation, bool) {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+
+	var latest *Operation
+	for _, op := range ops.operations {
+		if op.Service == service && (latest == nil || op.CreatedAt.After(latest.CreatedAt)) {
+			latest = op
+		}
+	}
+
+	if latest == nil {
+		return nil, false
+	}
+
+	snapshot := *latest
+	return &snapshot, true
+}
+
+// Updates sends a snapshot of an operation now and after each change
+// until it finishes. The channel is closed then or when ctx is done.
+func (ops *operationStore) Updates(ctx context.Context, id string) <-chan *Operation {
+	updates := make(chan *Operation)
+
+	go func() {
+		defer close(updates)
+
+		for {
+			ops.mutex.Lock()
+			op, ok := ops.operations[id]
+			changed := ops.changed
+			var snapshot Operation
+			if ok {
+				snapshot = *op
+			}
+			ops.mutex.Unlock()
+
+			if !ok {
+				return
+			}
+
+			select {
+			case updates <- &snapshot:
+			case <-ctx.Done():
+				return
+			}
+
+			if snapshot.FinishedAt != nil {
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates
+}
+
+// Run executes queued operations until ctx is done
+func (ops *operationStore) Run(ctx context.Context) {
+	for {
+		select {
+		case id := <-ops.queue:
+			ops.run(ctx, id)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ops *operationStore) run(ctx context.Context, id string) {
+	op, ok := ops.Get(id)
+	if !ok {
+		return
+	}
+
+	progress := &operationProgress{ops, id}
+
+	var result *DeployResult
+	var err error
+	switch op.Type {
+	case OperationRollback:
+		result, err = ops.containerService.Rollback(ctx, op.Service, progress)
+	case OperationRestart:
+		if _, err = ops.containerService.Restart(ctx, op.Service); err == nil {
+			progress.Phase(PhaseDone)
+		}
+	case OperationUndeploy:
+		if _, err = ops.containerService.Undeploy(ctx, op.Service); err == nil {
+			progress.Phase(PhaseDone)
+		}
+	default:
+		result, err = ops.containerService.Deploy(ctx, op.Service, progress)
+	}
+
+	ops.update(id, func(op *Operation) {
+		now := time.Now()
+		op.FinishedAt = &now
+		op.Result = result
+
+		if err != nil {
+			log.Printf("Fail to %s service %s: %v\n", op.Type, op.Service, err)
+			op.Phase = PhaseFailed
+			op.Error = err.Error()
+
+			var coded interface{ ErrorCode() string }
+			if errors.As(err, &coded) {
+				op.ErrorCode = coded.ErrorCode()
+			}
+		}
+	})
+}
+
+func (ops *operationStore) update(id string, fn func(*Operation)) {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+
+	if op, ok := ops.operations[id]; ok {
+		fn(op)
+
+		close(ops.changed)
+		ops.changed = make(chan struct{})
+	}
+}
+
+// prune drops the oldest finished operations. It must be called with the
+// mutex held.
+func (ops *operationStore) prune() {
+	var finished []*Operation
+	for _, op := range ops.operations {
+		if op.FinishedAt != nil {
+			finished = append(finished, op)
+		}
+	}
+
+	if len(finished) <= maxFinishedOperations {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(*finished[j].FinishedAt)
+	})
+
+	for _, op := range finished[:len(finished)-maxFinishedOperations] {
+		delete(ops.operations, op.ID)
+	}
+}
+
+type operationProgress struct {
+	store *operationStore
+	id    string
+}
+
+func (p *operationProgress) Phase(phase string) {
+	p.store.update(p.id, func(op *Operation) {
+		op.Phase = phase
+	})
+}
+
+func (p *operationProgress) Pulled(pulled, total int64, layers []LayerProgress) {
+	p.store.update(p.id, func(op *Operation) {
+		op.BytesPulled = pulled
+		op.BytesTotal = total
+		op.Layers = layers
+	})
+}
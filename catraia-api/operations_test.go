@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOperationUpdates(t *testing.T) {
+	ops := NewOperationService(nil).(*operationStore)
+
+	op, err := ops.Deploy("helloweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	updates := ops.Updates(ctx, op.ID)
+
+	if first := <-updates; first.Phase != PhasePending {
+		t.Errorf("want phase %s got %s\n", PhasePending, first.Phase)
+	}
+
+	progress := &operationProgress{ops, op.ID}
+	progress.Pulled(10, 20, []LayerProgress{{Digest: "sha256:1", Downloaded: 10, Total: 20}})
+
+	if update := <-updates; update.BytesPulled != 10 || len(update.Layers) != 1 {
+		t.Errorf("want 10 bytes pulled of one layer got %d of %d\n",
+			update.BytesPulled, len(update.Layers))
+	}
+
+	ops.update(op.ID, func(op *Operation) {
+		now := time.Now()
+		op.Phase = PhaseReady
+		op.FinishedAt = &now
+	})
+
+	if last := <-updates; last.FinishedAt == nil {
+		t.Error("want finished operation")
+	}
+
+	if _, ok := <-updates; ok {
+		t.Error("updates not closed after operation finished")
+	}
+
+	if latest, ok := ops.Latest("helloweb"); !ok || latest.ID != op.ID {
+		t.Errorf("want latest operation %s got %v\n", op.ID, latest)
+	}
+}
+
+type operationContainers struct {
+	ContainerService
+
+	deployErr error
+}
+
+func (c *operationContainers) Deploy(ctx context.Context, id string,
+	progress Progress) (*DeployResult, error) {
+
+	progress.Phase(PhaseReady)
+	if c.deployErr != nil {
+		return nil, c.deployErr
+	}
+
+	return &DeployResult{Container: ContainerCreated}, nil
+}
+
+func TestOperationQueue(t *testing.T) {
+	ops := NewOperationService(nil).(*operationStore)
+
+	var first, last *Operation
+	for i := 0; i < operationQueueSize; i++ {
+		op, err := ops.Deploy("helloweb")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if first == nil {
+			first = op
+		}
+		last = op
+	}
+
+	if _, err := ops.Deploy("helloweb"); err != errQueueFull {
+		t.Errorf("want %v got %v\n", errQueueFull, err)
+	}
+
+	if latest, ok := ops.Latest("helloweb"); !ok || latest.ID != last.ID {
+		t.Errorf("want latest operation %s got %v\n", last.ID, latest)
+	}
+
+	if _, ok := ops.Latest("helloworld"); ok {
+		t.Error("want no operation of a service never deployed")
+	}
+
+	if op, ok := ops.Get(first.ID); !ok || op.Phase != PhasePending {
+		t.Errorf("want pending operation %s got %v\n", first.ID, op)
+	}
+}
+
+func TestOperationRun(t *testing.T) {
+	containers := &operationContainers{}
+	ops := NewOperationService(containers).(*operationStore)
+
+	op, err := ops.Deploy("helloweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops.run(context.Background(), <-ops.queue)
+
+	done, _ := ops.Get(op.ID)
+	if done.FinishedAt == nil || done.Phase != PhaseReady || done.Result == nil {
+		t.Errorf("want finished ready operation got %v\n", done)
+	}
+
+	containers.deployErr = fmt.Errorf("deploy: %w",
+		verificationError(CodeSignatureMissing, "no signature"))
+
+	op, err = ops.Deploy("helloweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops.run(context.Background(), <-ops.queue)
+
+	failed, _ := ops.Get(op.ID)
+	if failed.Phase != PhaseFailed || failed.ErrorCode != CodeSignatureMissing {
+		t.Errorf("want failed with %s got %s with %q\n",
+			CodeSignatureMissing, failed.Phase, failed.ErrorCode)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/renatofq/catraia/handlers"
+)
+
+type reconcileHandler struct {
+	reconciler Reconciler
+}
+
+func newReconcileHandler(reconciler Reconciler) http.Handler {
+	return &reconcileHandler{reconciler}
+}
+
+func (s *reconcileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/reconcile/status" {
+		handlers.WriteError(w, http.StatusNotFound, errors.New("unknown reconcile resource"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		s.optionsStatus(w, r)
+	case http.MethodGet:
+		s.getStatus(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *reconcileHandler) optionsStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, GET")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *reconcileHandler) getStatus(w http.ResponseWriter, r *http.Request) {
+
+	status, ok := s.reconciler.Status()
+	if !ok {
+		handlers.WriteError(w, http.StatusNotFound, errors.New("no reconcile pass yet"))
+		return
+	}
+
+	handlers.WriteEntity(w, http.StatusOK, status)
+}
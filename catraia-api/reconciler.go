@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Desired states of a service kept by the reconciler
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+)
+
+// Reconcile actions
+const (
+	ActionNone     = "none"
+	ActionDeploy   = "deploy"
+	ActionRestart  = "restart"
+	ActionUndeploy = "undeploy"
+	ActionWait     = "wait"
+)
+
+// ServiceReconcile tells what a reconcile pass found for a service and what
+// it did about it. Operation is the operation it queued or waits for.
+type ServiceReconcile struct {
+	ID        string `json:"id"`
+	Desired   string `json:"desired"`
+	State     string `json:"state"`
+	Action    string `json:"action"`
+	Operation string `json:"operation,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ReconcileStatus is the outcome of a reconcile pass over the services
+// with a desired state
+type ReconcileStatus struct {
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt time.Time           `json:"finished_at"`
+	Error      string              `json:"error,omitempty"`
+	Services   []*ServiceReconcile `json:"services"`
+}
+
+// Reconciler brings services to their desired state on startup and every
+// interval, reporting the last pass
+type Reconciler interface {
+	Run(ctx context.Context)
+	Status() (*ReconcileStatus, bool)
+}
+
+type reconciler struct {
+	infoService      ImageInfoService
+	containerService ContainerService
+	opService        OperationService
+	interval         time.Duration
+
+	mutex sync.Mutex
+	last  *ReconcileStatus
+}
+
+func NewReconciler(infoService ImageInfoService, containerService ContainerService,
+	opService OperationService, interval time.Duration) Reconciler {
+
+	return &reconciler{
+		infoService:      infoService,
+		containerService: containerService,
+		opService:        opService,
+		interval:         interval,
+	}
+}
+
+// Run reconciles at once and then every interval until ctx is done. A
+// zero interval reconciles only on startup.
+func (r *reconciler) Run(ctx context.Context) {
+	r.reconcile(ctx)
+
+	if r.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.reconcile(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Status returns the last reconcile pass, if any
+func (r *reconciler) Status() (*ReconcileStatus, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.last == nil {
+		return nil, false
+	}
+
+	snapshot := *r.last
+	return &snapshot, true
+}
+
+func (r *reconciler) reconcile(ctx context.Context) *ReconcileStatus {
+	status := &ReconcileStatus{
+		StartedAt: time.Now(),
+		Services:  []*ServiceReconcile{},
+	}
+
+	defer func() {
+		status.FinishedAt = time.Now()
+
+		r.mutex.Lock()
+		r.last = status
+		r.mutex.Unlock()
+	}()
+
+	infos, err := r.infoService.List()
+	if err != nil {
+		log.Printf("Fail to list services to reconcile: %v\n", err)
+		status.Error = err.Error()
+		return status
+	}
+
+	statuses, err := r.containerService.List(ctx)
+	if err != nil {
+		log.Printf("Fail to list service states to reconcile: %v\n", err)
+		status.Error = err.Error()
+		return status
+	}
+
+	states := make(map[string]*ServiceStatus, len(statuses))
+	for _, s := range statuses {
+		states[s.ID] = s
+	}
+
+	for _, info := range infos {
+		if info.Desired == "" {
+			continue
+		}
+
+		result := &ServiceReconcile{
+			ID:      info.ID,
+			Desired: info.Desired,
+			State:   StateUnknown,
+			Action:  ActionNone,
+		}
+
+		s, ok := states[info.ID]
+		if ok {
+			result.State = s.State
+			result.Error = s.Error
+		} else {
+			s = &ServiceStatus{ID: info.ID, State: StateUnknown}
+		}
+
+		if result.Error == "" {
+			r.reconcileService(info, s, result)
+		}
+
+		if result.Error != "" {
+			log.Printf("Fail to reconcile service %s: %s\n", info.ID, result.Error)
+		}
+
+		status.Services = append(status.Services, result)
+	}
+
+	return status
+}
+
+// reconcileService queues an operation to bring a service to its desired
+// state. Services with an operation in course are left to it, as are
+// crash-looping ones and crashed ones in backoff, whose restarts the
+// supervisor holds back. The restart policy is for crashes only, any other
+// stopped service desired running is restarted.
+func (r *reconciler) reconcileService(info *ImageInfo, status *ServiceStatus,
+	result *ServiceReconcile) {
+
+	latest, ok := r.opService.Latest(result.ID)
+	if ok && latest.FinishedAt == nil {
+		result.Action = ActionWait
+		result.Operation = latest.ID
+		return
+	}
+
+	var op *Operation
+	var err error
+	switch result.Desired {
+	case DesiredRunning:
+		switch result.State {
+		case StateNotCreated, StateCreated:
+			result.Action = ActionDeploy
+
+			if op, err = r.opService.Deploy(result.ID); err == nil {
+				// the deploy is retried, but why it failed is still news
+				if latest != nil && latest.Type == OperationDeploy && latest.Error != "" {
+					result.Error = "previous deploy failed: " + latest.Error
+				}
+			}
+		case StateStopped:
+			var exitCode uint32
+			if status.ExitCode != nil {
+				exitCode = *status.ExitCode
+			}
+
+			if info.Restart.shouldRestart(exitCode) && status.Restarts > 0 {
+				// the supervisor restarts it once its backoff is over
+				result.Action = ActionWait
+			} else {
+				result.Action = ActionRestart
+				op, err = r.opService.Restart(result.ID)
+			}
+		}
+	case DesiredStopped:
+		// undeployed services keep their container, without a task
+		switch result.State {
+		case StateRunning, StatePaused, StateStopped, StateCrashLoop:
+			result.Action = ActionUndeploy
+			op, err = r.opService.Undeploy(result.ID)
+		}
+	}
+
+	if op != nil {
+		result.Operation = op.ID
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+}
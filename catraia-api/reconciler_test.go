@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type reconcileContainers struct {
+	ContainerService
+
+	states     []*ServiceStatus
+	restarted  []string
+	undeployed []string
+}
+
+func (c *reconcileContainers) List(ctx context.Context) ([]*ServiceStatus, error) {
+	return c.states, nil
+}
+
+func (c *reconcileContainers) Restart(ctx context.Context, id string) (*Info, error) {
+	c.restarted = append(c.restarted, id)
+	return &Info{ID: id}, nil
+}
+
+func (c *reconcileContainers) Undeploy(ctx context.Context, id string) (*UndeployResult, error) {
+	c.undeployed = append(c.undeployed, id)
+	return &UndeployResult{Service: id}, nil
+}
+
+func TestReconcile(t *testing.T) {
+	onFailure := RestartPolicy{Policy: RestartOnFailure}
+	infos := infoMap{
+		"backoff":    &ImageInfo{ID: "backoff", Desired: DesiredRunning, Restart: onFailure},
+		"created":    &ImageInfo{ID: "created", Desired: DesiredRunning},
+		"crashing":   &ImageInfo{ID: "crashing", Desired: DesiredRunning},
+		"deploying":  &ImageInfo{ID: "deploying", Desired: DesiredRunning},
+		"finished":   &ImageInfo{ID: "finished", Desired: DesiredRunning, Restart: onFailure},
+		"manual":     &ImageInfo{ID: "manual"},
+		"missing":    &ImageInfo{ID: "missing", Desired: DesiredRunning},
+		"norestart":  &ImageInfo{ID: "norestart", Desired: DesiredRunning, Restart: RestartPolicy{Policy: RestartNo}},
+		"retired":    &ImageInfo{ID: "retired", Desired: DesiredStopped},
+		"undeployed": &ImageInfo{ID: "undeployed", Desired: DesiredStopped},
+		"stopped":    &ImageInfo{ID: "stopped", Desired: DesiredRunning, Restart: onFailure},
+		"unreadable": &ImageInfo{ID: "unreadable", Desired: DesiredRunning},
+	}
+
+	failed, succeeded := uint32(1), uint32(0)
+	containers := &reconcileContainers{
+		states: []*ServiceStatus{
+			{ID: "backoff", State: StateStopped, ExitCode: &failed, Restarts: 2},
+			{ID: "created", State: StateCreated},
+			{ID: "crashing", State: StateCrashLoop},
+			{ID: "deploying", State: StateNotCreated},
+			{ID: "finished", State: StateStopped, ExitCode: &succeeded},
+			{ID: "manual", State: StateStopped},
+			{ID: "missing", State: StateNotCreated},
+			{ID: "norestart", State: StateStopped, ExitCode: &failed},
+			{ID: "retired", State: StateRunning},
+			{ID: "undeployed", State: StateCreated},
+			{ID: "stopped", State: StateStopped, ExitCode: &failed},
+			{ID: "unreadable", State: StateUnknown, Error: "containerd is gone"},
+		},
+	}
+
+	ops := NewOperationService(containers).(*operationStore)
+	pending, err := ops.Deploy("deploying")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReconciler(infos, containers, ops, 0).(*reconciler)
+	if _, ok := r.Status(); ok {
+		t.Error("want no status before the first pass")
+	}
+
+	r.reconcile(context.Background())
+
+	status, ok := r.Status()
+	if !ok {
+		t.Fatal("want status after a pass")
+	}
+
+	actions := make(map[string]string)
+	for _, s := range status.Services {
+		actions[s.ID] = s.Action
+	}
+
+	expected := map[string]string{
+		"backoff":    ActionWait,
+		"created":    ActionDeploy,
+		"crashing":   ActionNone,
+		"deploying":  ActionWait,
+		"finished":   ActionRestart,
+		"missing":    ActionDeploy,
+		"norestart":  ActionRestart,
+		"retired":    ActionUndeploy,
+		"undeployed": ActionNone,
+		"stopped":    ActionRestart,
+		"unreadable": ActionNone,
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("want %v got %v\n", expected, actions)
+	}
+
+	// restarts and undeploys are queued, not run by the reconciler
+	if len(containers.restarted) != 0 || len(containers.undeployed) != 0 {
+		t.Errorf("want nothing run yet got %v and %v\n", containers.restarted, containers.undeployed)
+	}
+
+	for id, typ := range map[string]string{"stopped": OperationRestart, "retired": OperationUndeploy} {
+		op, ok := ops.Latest(id)
+		if !ok || op.Type != typ {
+			t.Fatalf("want %s queued for %s got %v\n", typ, id, op)
+		}
+
+		ops.run(context.Background(), op.ID)
+
+		if done, _ := ops.Get(op.ID); done.Phase != PhaseDone || done.Error != "" {
+			t.Errorf("want %s done got %s %s\n", typ, done.Phase, done.Error)
+		}
+	}
+
+	if !reflect.DeepEqual(containers.restarted, []string{"stopped"}) {
+		t.Errorf("want stopped restarted got %v\n", containers.restarted)
+	}
+
+	// the restart policy is for crashes, desired running wins over it
+	for _, id := range []string{"finished", "norestart"} {
+		if op, ok := ops.Latest(id); !ok || op.Type != OperationRestart {
+			t.Errorf("want restart queued for %s got %v\n", id, op)
+		}
+	}
+
+	if !reflect.DeepEqual(containers.undeployed, []string{"retired"}) {
+		t.Errorf("want retired undeployed got %v\n", containers.undeployed)
+	}
+
+	// the next pass waits for the operation still queued for retired
+	queued, _ := ops.Undeploy("retired")
+	r.reconcile(context.Background())
+
+	status, _ = r.Status()
+	for _, s := range status.Services {
+		if s.ID == "retired" && (s.Action != ActionWait || s.Operation != queued.ID) {
+			t.Errorf("want wait for %s got %s %s\n", queued.ID, s.Action, s.Operation)
+		}
+	}
+
+	if latest, _ := ops.Latest("deploying"); latest.ID != pending.ID {
+		t.Errorf("want pending deploy %s kept got %s\n", pending.ID, latest.ID)
+	}
+
+	for _, s := range status.Services {
+		if s.ID == "unreadable" && s.Error == "" {
+			t.Error("want error of unreadable service")
+		}
+	}
+}
+
+func TestParseDesired(t *testing.T) {
+	result, err := parseInfoData(strings.NewReader(`{ "helloweb" : { "autostart" : true } }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result["helloweb"].Desired != DesiredRunning {
+		t.Errorf("want %s got %s\n", DesiredRunning, result["helloweb"].Desired)
+	}
+
+	invalid := []string{
+		`{ "helloweb" : { "desired" : "sleeping" } }`,
+		`{ "helloweb" : { "desired" : "stopped", "autostart" : true } }`,
+	}
+	for _, data := range invalid {
+		if _, err := parseInfoData(strings.NewReader(data)); err == nil {
+			t.Errorf("invalid desired state accepted: %s\n", data)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// tries of each registry endpoint when pulling, unless configured
+const defaultPullAttempts = 3
+
+// RegistryHost holds the credentials and connection settings of a
+// registry. Username and Password are used for basic or token auth and
+// Token is sent as a bearer token as is. Mirrors are tried in order before
+// the registry itself.
+type RegistryHost struct {
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+	Token     string   `json:"token"`
+	Insecure  bool     `json:"insecure"`
+	PlainHTTP bool     `json:"plain_http"`
+	CAFile    string   `json:"ca_file"`
+	Mirrors   []string `json:"mirrors"`
+}
+
+// RegistryConfig configures registries by host, as written in image refs.
+// Credentials missing from Hosts are looked up in DockerConfig, a Docker
+// config.json. Attempts is how many times each endpoint is tried on pulls.
+type RegistryConfig struct {
+	DockerConfig string                   `json:"docker_config"`
+	Hosts        map[string]*RegistryHost `json:"hosts"`
+	Attempts     int                      `json:"attempts"`
+
+	dockerAuths map[string]dockerAuth
+}
+
+// PullAttempt is a failed try to reach a registry endpoint
+type PullAttempt struct {
+	Endpoint string `json:"endpoint"`
+	Attempt  int    `json:"attempt"`
+	Error    string `json:"error"`
+}
+
+type dockerConfigFile struct {
+	Auths map[string]dockerAuth `json:"auths"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// LoadRegistryConfig reads the registry configuration. A missing file
+// means no configuration.
+func LoadRegistryConfig(path string) (*RegistryConfig, error) {
+	rc := &RegistryConfig{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, rc); err != nil {
+			return nil, fmt.Errorf("invalid registry config: %v", err)
+		}
+	}
+
+	if rc.DockerConfig != "" {
+		if rc.dockerAuths, err = readDockerAuths(rc.DockerConfig); err != nil {
+			return nil, fmt.Errorf("invalid docker config %s: %v", rc.DockerConfig, err)
+		}
+	}
+
+	return rc, nil
+}
+
+func readDockerAuths(path string) (map[string]dockerAuth, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file dockerConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	auths := make(map[string]dockerAuth, len(file.Auths))
+	for key, auth := range file.Auths {
+		auths[dockerConfigHost(key)] = auth
+	}
+
+	return auths, nil
+}
+
+// dockerConfigHost turns a Docker config key, which may be an URL such as
+// https://index.docker.io/v1/, into the registry host of image refs
+func dockerConfigHost(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	default:
+		return host
+	}
+}
+
+// registryEndpoint is a registry, or one of its mirrors, reachable for the
+// images of a host
+type registryEndpoint struct {
+	url  string
+	host docker.RegistryHost
+	err  error
+}
+
+// endpoints lists the mirrors of a registry host in order, followed by
+// the host itself
+func (rc *RegistryConfig) endpoints(host string) []registryEndpoint {
+	var endpoints []registryEndpoint
+
+	if settings := rc.Hosts[host]; settings != nil {
+		for _, mirror := range settings.Mirrors {
+			endpoints = append(endpoints, rc.mirrorEndpoint(mirror))
+		}
+	}
+
+	address := host
+	if host == "docker.io" {
+		address = "registry-1.docker.io"
+	}
+
+	scheme := "https"
+	if settings := rc.Hosts[host]; settings != nil && settings.PlainHTTP {
+		scheme = "http"
+	}
+
+	return append(endpoints, rc.endpoint(host, scheme, address, "/v2"))
+}
+
+// mirrorEndpoint parses a mirror given as an URL or as a host, in which
+// case https is used. Mirrors get the settings of their own host.
+func (rc *RegistryConfig) mirrorEndpoint(mirror string) registryEndpoint {
+	if !strings.Contains(mirror, "://") {
+		mirror = "https://" + mirror
+	}
+
+	u, err := url.Parse(mirror)
+	if err != nil || u.Host == "" {
+		return registryEndpoint{url: mirror, err: fmt.Errorf("invalid mirror %s", mirror)}
+	}
+
+	scheme := u.Scheme
+	if settings := rc.Hosts[u.Host]; settings != nil && settings.PlainHTTP {
+		scheme = "http"
+	}
+
+	return rc.endpoint(u.Host, scheme, u.Host, strings.TrimSuffix(u.Path, "/")+"/v2")
+}
+
+// endpoint configures the access to a registry address with the settings
+// of host
+func (rc *RegistryConfig) endpoint(host, scheme, address, path string) registryEndpoint {
+	ep := registryEndpoint{url: scheme + "://" + address + path}
+
+	settings := rc.Hosts[host]
+	if settings == nil {
+		settings = &RegistryHost{}
+	}
+
+	client, err := registryClient(settings)
+	if err != nil {
+		ep.err = fmt.Errorf("registry %s: %v", host, err)
+		return ep
+	}
+
+	ep.host = docker.RegistryHost{
+		Client:       client,
+		Host:         address,
+		Scheme:       scheme,
+		Path:         path,
+		Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+	}
+
+	token := settings.Token
+	if token == "" {
+		token = rc.dockerAuths[host].RegistryToken
+	}
+
+	if token != "" {
+		ep.host.Header = http.Header{"Authorization": {"Bearer " + token}}
+	} else {
+		ep.host.Authorizer = docker.NewDockerAuthorizer(
+			docker.WithAuthClient(client),
+			docker.WithAuthCreds(func(string) (string, string, error) {
+				return rc.credentials(host)
+			}))
+	}
+
+	return ep
+}
+
+func (ep registryEndpoint) resolver() remotes.Resolver {
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{ep.host}, nil
+		},
+	})
+}
+
+func (rc *RegistryConfig) attempts() int {
+	if rc.Attempts <= 0 {
+		return defaultPullAttempts
+	}
+
+	return rc.Attempts
+}
+
+// withFallback calls fn with a resolver for each endpoint of the registry
+// of ref until it succeeds, up to attempts times per endpoint with backoff
+// in between. It returns the failed attempts.
+func (rc *RegistryConfig) withFallback(ctx context.Context, ref string, attempts int,
+	fn func(remotes.Resolver) error) ([]PullAttempt, error) {
+
+	spec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []PullAttempt
+	for _, ep := range rc.endpoints(spec.Hostname()) {
+		if ep.err != nil {
+			failed = append(failed, PullAttempt{ep.url, 1, ep.err.Error()})
+			err = ep.err
+			continue
+		}
+
+		resolver := ep.resolver()
+		for attempt := 1; attempt <= attempts; attempt++ {
+			if err = fn(resolver); err == nil {
+				return failed, nil
+			}
+
+			if ctx.Err() != nil {
+				return failed, err
+			}
+
+			log.Printf("Attempt %d at %s failed: %v\n", attempt, ep.url, err)
+			failed = append(failed, PullAttempt{ep.url, attempt, err.Error()})
+
+			// the endpoint answered, retrying will not change it
+			if errdefs.IsNotFound(err) || attempt == attempts {
+				break
+			}
+
+			select {
+			case <-time.After(backoff(attempt - 1)):
+			case <-ctx.Done():
+				return failed, ctx.Err()
+			}
+		}
+	}
+
+	return failed, err
+}
+
+// credentials returns the username and secret of a registry host. An
+// empty username with a secret is taken as an identity token.
+func (rc *RegistryConfig) credentials(host string) (string, string, error) {
+	if settings := rc.Hosts[host]; settings != nil && settings.Username != "" {
+		return settings.Username, settings.Password, nil
+	}
+
+	auth, ok := rc.dockerAuths[host]
+	if !ok {
+		return "", "", nil
+	}
+
+	if auth.IdentityToken != "" {
+		return "", auth.IdentityToken, nil
+	}
+
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid docker auth for %s: %v", host, err)
+		}
+
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("invalid docker auth for %s", host)
+		}
+
+		return parts[0], parts[1], nil
+	}
+
+	return auth.Username, auth.Password, nil
+}
+
+func registryClient(settings *RegistryHost) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: settings.Insecure,
+	}
+
+	if settings.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		data, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", settings.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 5 * time.Second,
+			IdleConnTimeout:       30 * time.Second,
+		},
+	}, nil
+}
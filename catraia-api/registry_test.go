@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+)
+
+func TestRegistryCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("hubuser:hubpass"))
+	dockerConfig := filepath.Join(dir, "config.json")
+	dockerData := `{ "auths" : {
+	  "https://index.docker.io/v1/" : { "auth" : "` + auth + `" },
+	  "registry.example.com" : { "registrytoken" : "abc" }
+	} }`
+	if err := ioutil.WriteFile(dockerConfig, []byte(dockerData), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "registries.json")
+	data := `{
+	  "docker_config" : "` + dockerConfig + `",
+	  "hosts" : {
+	    "docker.io" : { "username" : "user", "password" : "pass" },
+	    "localhost:5000" : { "plain_http" : true }
+	  }
+	}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := LoadRegistryConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// configured hosts take precedence over the docker config
+	if user, secret, _ := rc.credentials("docker.io"); user != "user" || secret != "pass" {
+		t.Errorf("want user/pass got %s/%s\n", user, secret)
+	}
+
+	delete(rc.Hosts, "docker.io")
+	if user, secret, _ := rc.credentials("docker.io"); user != "hubuser" || secret != "hubpass" {
+		t.Errorf("want hubuser/hubpass got %s/%s\n", user, secret)
+	}
+
+	ep := rc.endpoints("registry.example.com")[0]
+	if ep.err != nil {
+		t.Fatal(ep.err)
+	}
+	if header := ep.host.Header.Get("Authorization"); header != "Bearer abc" {
+		t.Errorf("want bearer token got %q\n", header)
+	}
+
+	ep = rc.endpoints("localhost:5000")[0]
+	if ep.err != nil {
+		t.Fatal(ep.err)
+	}
+	if ep.host.Scheme != "http" {
+		t.Errorf("want plain http got %s\n", ep.host.Scheme)
+	}
+
+	if _, err := LoadRegistryConfig(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("missing config refused: %v\n", err)
+	}
+}
+
+func TestRegistryMirrors(t *testing.T) {
+	rc := &RegistryConfig{
+		Hosts: map[string]*RegistryHost{
+			"docker.io": {Mirrors: []string{
+				"mirror.example.com",
+				"http://cache.local:5000/proxy/",
+				"http://",
+			}},
+		},
+	}
+
+	want := []string{
+		"https://mirror.example.com/v2",
+		"http://cache.local:5000/proxy/v2",
+		"http://",
+		"https://registry-1.docker.io/v2",
+	}
+
+	endpoints := rc.endpoints("docker.io")
+	if len(endpoints) != len(want) {
+		t.Fatalf("want %d endpoints got %d\n", len(want), len(endpoints))
+	}
+
+	for i, ep := range endpoints {
+		if ep.url != want[i] {
+			t.Errorf("want %s got %s\n", want[i], ep.url)
+		}
+	}
+
+	if endpoints[2].err == nil {
+		t.Errorf("want invalid mirror refused\n")
+	}
+
+	// not found is not retried, other errors are, and the last endpoint
+	// succeeds
+	rc.Attempts = 2
+	calls := 0
+	attempts, err := rc.withFallback(context.Background(), "docker.io/library/busybox:latest",
+		rc.attempts(), func(remotes.Resolver) error {
+			calls++
+			switch calls {
+			case 1:
+				return errdefs.ErrNotFound
+			case 2, 3:
+				return errors.New("connection refused")
+			default:
+				return nil
+			}
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 4 {
+		t.Errorf("want 4 calls got %d\n", calls)
+	}
+
+	if len(attempts) != 4 {
+		t.Fatalf("want 4 failed attempts got %d\n", len(attempts))
+	}
+
+	if attempts[2].Endpoint != want[1] || attempts[2].Attempt != 2 {
+		t.Errorf("want attempt 2 at %s got %+v\n", want[1], attempts[2])
+	}
+}
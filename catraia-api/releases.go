@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+)
+
+// Release is a successful deploy of a service: the image it ran, pinned by
+// digest, and the service info its spec was generated from
+type Release struct {
+	Image      string    `json:"image"`
+	Digest     string    `json:"digest"`
+	SpecHash   string    `json:"spec_hash"`
+	Info       ImageInfo `json:"info"`
+	DeployedAt time.Time `json:"deployed_at"`
+}
+
+type serviceReleases struct {
+	Current  *Release `json:"current"`
+	Previous *Release `json:"previous,omitempty"`
+}
+
+// releaseStore keeps the last two releases of each service in a file, so
+// known-good deploys survive restarts of catraia-api
+type releaseStore struct {
+	path string
+
+	mutex    sync.Mutex
+	releases map[string]*serviceReleases
+}
+
+func newReleaseStore(path string) (*releaseStore, error) {
+	rs := &releaseStore{
+		path:     path,
+		releases: make(map[string]*serviceReleases),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &rs.releases); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// Current returns the last known-good release of a service
+func (rs *releaseStore) Current(id string) (*Release, bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	releases, ok := rs.releases[id]
+	if !ok || releases.Current == nil {
+		return nil, false
+	}
+
+	return rs.release(id, releases.Current), true
+}
+
+// Previous returns the release that preceded the current one
+func (rs *releaseStore) Previous(id string) (*Release, bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	releases, ok := rs.releases[id]
+	if !ok || releases.Previous == nil {
+		return nil, false
+	}
+
+	return rs.release(id, releases.Previous), true
+}
+
+// Record makes release the current one of a service. Recording the
+// previous release swaps both, so rolling back twice goes forward again.
+func (rs *releaseStore) Record(id string, release *Release) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	releases, ok := rs.releases[id]
+	if !ok {
+		releases = &serviceReleases{}
+		rs.releases[id] = releases
+	}
+
+	if releases.Current != nil && releases.Current.SpecHash == release.SpecHash {
+		releases.Current = release
+	} else {
+		releases.Previous = releases.Current
+		releases.Current = release
+	}
+
+	return rs.save()
+}
+
+func (rs *releaseStore) release(id string, release *Release) *Release {
+	snapshot := *release
+	snapshot.Info.ID = id
+	return &snapshot
+}
+
+// save writes the releases to a temporary file renamed over the previous
+// one. It must be called with the mutex held.
+func (rs *releaseStore) save() error {
+	data, err := json.MarshalIndent(rs.releases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rs.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := rs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, rs.path)
+}
+
+// pinImage names an image by its digest, keeping it available to a
+// rollback after its tag moves to another image
+func pinImage(ctx context.Context, client *containerd.Client,
+	image containerd.Image) (string, error) {
+
+	spec, err := reference.Parse(image.Name())
+	if err != nil {
+		return "", err
+	}
+
+	name := spec.Locator + "@" + image.Target().Digest.String()
+	if name == image.Name() {
+		return name, nil
+	}
+
+	_, err = client.ImageService().Create(ctx, images.Image{
+		Name:   name,
+		Target: image.Target(),
+	})
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// deployRelease deploys the image and spec of a release
+func (c *service) deployRelease(ctx context.Context, client *containerd.Client,
+	release *Release, progress Progress) (*deployment, error) {
+
+	image, err := client.GetImage(ctx, release.Image)
+	if err != nil {
+		return nil, fmt.Errorf("image of release %s not found: %v", release.Digest, err)
+	}
+
+	unpacked, err := image.IsUnpacked(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if !unpacked {
+		progress.Phase(PhaseUnpacking)
+		if err := image.Unpack(ctx, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := c.ensureTask(ctx, client, &release.Info, image, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	c.finish(ctx, release.Info.ID, d, progress)
+
+	return d, nil
+}
+
+// restore brings a service back to its last known-good release after a
+// failed deploy. The deploy error is returned either way, along with the
+// result of the restore when it succeeds.
+func (c *service) restore(ctx context.Context, client *containerd.Client,
+	id string, deployErr error) (*DeployResult, error) {
+
+	release, ok := c.releases.Current(id)
+	if !ok || ctx.Err() != nil {
+		return nil, deployErr
+	}
+
+	log.Printf("Deploy of service %s failed, restoring %s: %v\n",
+		id, release.Digest, deployErr)
+
+	d, err := c.deployRelease(ctx, client, release, noProgress{})
+	if err != nil {
+		log.Printf("Fail to restore service %s: %v\n", id, err)
+		rollbacksTotal.Inc(id, "failure")
+		return nil, deployErr
+	}
+
+	// an unchanged container means the failed deploy never replaced it
+	if d.result.Container != ContainerUnchanged {
+		rollbacksTotal.Inc(id, "success")
+		d.result.RolledBack = true
+	}
+
+	return d.result, deployErr
+}
+
+// record makes a deployment the known-good release of its service
+func (c *service) record(ctx context.Context, client *containerd.Client,
+	imageInfo *ImageInfo, d *deployment) {
+
+	name, err := pinImage(ctx, client, d.image)
+	if err != nil {
+		log.Printf("Fail to pin image of service %s: %v\n", imageInfo.ID, err)
+		return
+	}
+
+	release := &Release{
+		Image:      name,
+		Digest:     d.image.Target().Digest.String(),
+		SpecHash:   d.hash,
+		Info:       *imageInfo,
+		DeployedAt: time.Now(),
+	}
+
+	if err := c.releases.Record(imageInfo.ID, release); err != nil {
+		log.Printf("Fail to record release of service %s: %v\n", imageInfo.ID, err)
+	}
+}
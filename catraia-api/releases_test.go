@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReleaseStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-releases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "releases.json")
+	rs, err := newReleaseStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := rs.Current("helloweb"); ok {
+		t.Error("release found in empty store")
+	}
+
+	first := &Release{Digest: "sha256:1", SpecHash: "a"}
+	second := &Release{Digest: "sha256:2", SpecHash: "b"}
+
+	for _, release := range []*Release{first, second, second} {
+		if err := rs.Record("helloweb", release); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reload from disk
+	rs, err = newReleaseStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, ok := rs.Current("helloweb")
+	if !ok || current.Digest != "sha256:2" || current.Info.ID != "helloweb" {
+		t.Errorf("want current sha256:2 got %v\n", current)
+	}
+
+	previous, ok := rs.Previous("helloweb")
+	if !ok || previous.Digest != "sha256:1" {
+		t.Errorf("want previous sha256:1 got %v\n", previous)
+	}
+
+	// rolling back swaps current and previous
+	if err := rs.Record("helloweb", previous); err != nil {
+		t.Fatal(err)
+	}
+
+	if current, _ := rs.Current("helloweb"); current.Digest != "sha256:1" {
+		t.Errorf("want current sha256:1 got %s\n", current.Digest)
+	}
+
+	if previous, _ := rs.Previous("helloweb"); previous.Digest != "sha256:2" {
+		t.Errorf("want previous sha256:2 got %s\n", previous.Digest)
+	}
+}
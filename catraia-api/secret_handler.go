@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/renatofq/catraia/handlers"
+)
+
+type secretHandler struct {
+	secrets *secretStore
+}
+
+func newSecretHandler(secrets *secretStore) http.Handler {
+	return &secretHandler{secrets}
+}
+
+func (s *secretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		s.optionsSecret(w, r)
+	case http.MethodPut:
+		s.putSecret(w, r)
+	case http.MethodDelete:
+		s.deleteSecret(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *secretHandler) optionsSecret(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, PUT, DELETE")
+	w.WriteHeader(http.StatusOK)
+}
+
+// putSecret stores the request body as the value of a secret
+func (s *secretHandler) putSecret(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(r.URL.Path, "/secrets/")
+
+	value, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSecretSize+1))
+	if err != nil {
+		handlers.WriteError(w, http.StatusBadRequest, errors.New("fail to read secret"))
+		return
+	}
+
+	switch err := s.secrets.Put(name, value); err {
+	case nil:
+		handlers.WriteEntity(w, http.StatusOK, "secret stored")
+	case errInvalidSecretName, errSecretTooLarge:
+		handlers.WriteError(w, http.StatusBadRequest, err)
+	default:
+		log.Printf("Fail to store secret %s: %v\n", name, err)
+		handlers.WriteError(w, http.StatusInternalServerError,
+			errors.New("fail to store secret"))
+	}
+}
+
+func (s *secretHandler) deleteSecret(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(r.URL.Path, "/secrets/")
+
+	switch err := s.secrets.Delete(name); err {
+	case nil:
+		handlers.WriteEntity(w, http.StatusOK, "secret removed")
+	case errInvalidSecretName:
+		handlers.WriteError(w, http.StatusBadRequest, err)
+	case errSecretNotFound:
+		handlers.WriteError(w, http.StatusNotFound, err)
+	default:
+		log.Printf("Fail to remove secret %s: %v\n", name, err)
+		handlers.WriteError(w, http.StatusInternalServerError,
+			errors.New("fail to remove secret"))
+	}
+}
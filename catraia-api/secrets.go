@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// largest secret value accepted
+const maxSecretSize = 1024 * 1024
+
+// annotation prefix of the digests of the secrets given to a service as
+// files, so that a new value changes its spec hash as env secrets do
+const secretDigestAnnotation = "io.catraia.secret."
+
+var (
+	errSecretNotFound    = errors.New("secret not found")
+	errInvalidSecretName = errors.New("invalid secret name")
+	errSecretTooLarge    = errors.New("secret is too large")
+)
+
+var secretNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// secretStore keeps secret values encrypted with AES-GCM under dir, with a
+// key generated on first use. Secrets given to services as files are
+// written decrypted under runDir, which is expected on a tmpfs.
+type secretStore struct {
+	dir     string
+	keyPath string
+	runDir  string
+
+	mutex sync.Mutex
+	aead  cipher.AEAD
+}
+
+func newSecretStore(dir, keyPath, runDir string) *secretStore {
+	return &secretStore{
+		dir:     dir,
+		keyPath: keyPath,
+		runDir:  runDir,
+	}
+}
+
+// Put stores the value of a secret, replacing any previous one
+func (ss *secretStore) Put(name string, value []byte) error {
+	if !secretNamePattern.MatchString(name) {
+		return errInvalidSecretName
+	}
+
+	if len(value) > maxSecretSize {
+		return errSecretTooLarge
+	}
+
+	aead, err := ss.cipher()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(ss.dir, 0700); err != nil {
+		return err
+	}
+
+	// the name is authenticated, so a file renamed to another secret does
+	// not decrypt
+	data := aead.Seal(nonce, nonce, value, []byte(name))
+
+	return replaceFile(filepath.Join(ss.dir, name), data, 0600, nil)
+}
+
+// Get returns the decrypted value of a secret
+func (ss *secretStore) Get(name string) ([]byte, error) {
+	if !secretNamePattern.MatchString(name) {
+		return nil, errInvalidSecretName
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(ss.dir, name))
+	if os.IsNotExist(err) {
+		return nil, errSecretNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := ss.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("secret %s is corrupted", name)
+	}
+
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, sealed, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("fail to decrypt secret %s: %v", name, err)
+	}
+
+	return value, nil
+}
+
+// Delete removes a secret. Services keep the files given to them until
+// they are deployed again.
+func (ss *secretStore) Delete(name string) error {
+	if !secretNamePattern.MatchString(name) {
+		return errInvalidSecretName
+	}
+
+	err := os.Remove(filepath.Join(ss.dir, name))
+	if os.IsNotExist(err) {
+		return errSecretNotFound
+	}
+
+	return err
+}
+
+// inject decrypts the secrets of a service: the ones given as files are
+// written under the runtime directory and returned as read-only mounts
+// along with the digests of their values, the others as environment
+// variables. Files of a service in a user namespace are owned by its root.
+func (ss *secretStore) inject(info *ImageInfo,
+	mapping *IDMapping) ([]specs.Mount, []string, map[string]string, error) {
+
+	var mounts []specs.Mount
+	var env []string
+	digests := make(map[string]string)
+
+	for _, ref := range info.Secrets {
+		value, err := ss.Get(ref.Name)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("secret %s of service %s: %w", ref.Name, info.ID, err)
+		}
+
+		if ref.Env != "" {
+			env = append(env, ref.Env+"="+string(value))
+			continue
+		}
+
+		dir := filepath.Join(ss.runDir, info.ID)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, nil, nil, err
+		}
+
+		// replaced rather than rewritten, containers of older generations
+		// keep the value they started with
+		path := filepath.Join(dir, ref.Name)
+		if err := replaceFile(path, value, 0400, mapping); err != nil {
+			return nil, nil, nil, err
+		}
+
+		digests[secretDigestAnnotation+ref.Name] = digest.FromBytes(value).String()
+
+		mounts = append(mounts, specs.Mount{
+			Destination: ref.File,
+			Type:        "bind",
+			Source:      path,
+			Options:     []string{"rbind", "ro"},
+		})
+	}
+
+	return mounts, env, digests, nil
+}
+
+// replaceFile writes data to a new file in the directory of path, which
+// it then replaces. Temporary files start with a dot, never the start of a
+// secret name. The file is owned by the root of mapping when there is one.
+func replaceFile(path string, data []byte, mode os.FileMode, mapping *IDMapping) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	if mapping != nil {
+		if err := os.Lchown(tmp.Name(), int(mapping.HostID), int(mapping.HostID)); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// clear removes the secret files written for a service
+func (ss *secretStore) clear(id string) error {
+	return os.RemoveAll(filepath.Join(ss.runDir, id))
+}
+
+// cipher loads the host key, generating it the first time
+func (ss *secretStore) cipher() (cipher.AEAD, error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.aead != nil {
+		return ss.aead, nil
+	}
+
+	key, err := ioutil.ReadFile(ss.keyPath)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(ss.keyPath), 0700); err != nil {
+			return nil, err
+		}
+
+		if err := ioutil.WriteFile(ss.keyPath, key, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key %s: %v", ss.keyPath, err)
+	}
+
+	if ss.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	return ss.aead, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ss := newSecretStore(filepath.Join(dir, "secrets"), filepath.Join(dir, "secret.key"),
+		filepath.Join(dir, "run"))
+
+	if err := ss.Put("api-key", []byte("s3cr3t")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "secrets", "api-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("s3cr3t")) {
+		t.Errorf("secret stored in clear\n")
+	}
+
+	// a new store reads the key written by the first one
+	ss = newSecretStore(ss.dir, ss.keyPath, ss.runDir)
+	if value, err := ss.Get("api-key"); err != nil || string(value) != "s3cr3t" {
+		t.Errorf("want s3cr3t got %q, %v\n", value, err)
+	}
+
+	// the value is bound to the name of the secret
+	if err := os.Rename(filepath.Join(dir, "secrets", "api-key"),
+		filepath.Join(dir, "secrets", "other")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Get("other"); err == nil {
+		t.Errorf("want renamed secret refused\n")
+	}
+
+	if err := ss.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Get("other"); err != errSecretNotFound {
+		t.Errorf("want %v got %v\n", errSecretNotFound, err)
+	}
+
+	if err := ss.Put("../key", []byte("x")); err != errInvalidSecretName {
+		t.Errorf("want %v got %v\n", errInvalidSecretName, err)
+	}
+}
+
+func TestInjectSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ss := newSecretStore(filepath.Join(dir, "secrets"), filepath.Join(dir, "secret.key"),
+		filepath.Join(dir, "run"))
+
+	if err := ss.Put("token", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Put("config", []byte("debug = true\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &ImageInfo{
+		ID: "helloweb",
+		Secrets: []SecretRef{
+			{Name: "token", Env: "API_TOKEN"},
+			{Name: "config", File: "/etc/helloweb.conf"},
+		},
+	}
+
+	mounts, env, digests, err := ss.inject(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(env) != 1 || env[0] != "API_TOKEN=abc" {
+		t.Errorf("want API_TOKEN=abc got %v\n", env)
+	}
+
+	if len(mounts) != 1 || mounts[0].Destination != "/etc/helloweb.conf" ||
+		mounts[0].Options[1] != "ro" {
+		t.Fatalf("want read-only mount at /etc/helloweb.conf got %v\n", mounts)
+	}
+
+	if data, err := ioutil.ReadFile(mounts[0].Source); err != nil || string(data) != "debug = true\n" {
+		t.Errorf("want config file got %q, %v\n", data, err)
+	}
+
+	if len(digests) != 1 || digests[secretDigestAnnotation+"config"] == "" {
+		t.Fatalf("want digest of the config file only got %v\n", digests)
+	}
+
+	// a new value of a file secret changes its digest, and so the spec hash
+	if err := ss.Put("config", []byte("debug = false\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, rotated, err := ss.inject(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated[secretDigestAnnotation+"config"] == digests[secretDigestAnnotation+"config"] {
+		t.Errorf("want digest changed with the value\n")
+	}
+
+	// secrets named as temporary files do not collide with them
+	if err := ss.Put("config.tmp", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Put("config", []byte("debug = true\n")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := ss.Get("config.tmp"); err != nil || string(value) != "other" {
+		t.Errorf("want config.tmp kept got %q, %v\n", value, err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(mounts[0].Source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("want only the config file left got %d files\n", len(entries))
+	}
+
+	info.Secrets = append(info.Secrets, SecretRef{Name: "missing", Env: "MISSING"})
+	if _, _, _, err := ss.inject(info, nil); err == nil {
+		t.Errorf("want missing secret refused\n")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/renatofq/catraia/metrics"
+)
+
+var (
+	deploysTotal = metrics.NewCounter("catraia_deploys_total",
+		"Service deploys by result.", "service", "result")
+	deployDuration = metrics.NewHistogram("catraia_deploy_duration_seconds",
+		"Time taken to deploy a service.", nil, "service")
+	undeploysTotal = metrics.NewCounter("catraia_undeploys_total",
+		"Service undeploys by result.", "service", "result")
+	undeployDuration = metrics.NewHistogram("catraia_undeploy_duration_seconds",
+		"Time taken to undeploy a service.", nil, "service")
+	rollbacksTotal = metrics.NewCounter("catraia_rollbacks_total",
+		"Service rollbacks, explicit or after a failed deploy, by result.",
+		"service", "result")
+	rollbackDuration = metrics.NewHistogram("catraia_rollback_duration_seconds",
+		"Time taken to roll back a service.", nil, "service")
+	imagePullsTotal = metrics.NewCounter("catraia_image_pulls_total",
+		"Image pulls by result.", "result")
+	imagePullDuration = metrics.NewHistogram("catraia_image_pull_duration_seconds",
+		"Time taken to pull and unpack an image.", nil)
+	imagesRemovedTotal = metrics.NewCounter("catraia_images_removed_total",
+		"Images removed by the garbage collector.")
+	serviceRestartsTotal = metrics.NewCounter("catraia_service_restarts_total",
+		"Restarts of service tasks by the supervisor, by result.", "service", "result")
+	tunnelConnectionsTotal = metrics.NewCounter("catraia_tunnel_connections_total",
+		"Connections accepted by the tunnel.")
+	tunnelActiveConnections = metrics.NewGauge("catraia_tunnel_active_connections",
+		"Connections currently open through the tunnel.")
+	tunnelBytesTotal = metrics.NewCounter("catraia_tunnel_bytes_total",
+		"Bytes copied through the tunnel.", "direction")
+)
+
+// observe records the result and duration of an operation started at start
+func observe(counter *metrics.Counter, histogram *metrics.Histogram,
+	start time.Time, err error, labels ...string) {
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	counter.Inc(append(labels, result)...)
+	histogram.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// containerCollector exports the state and resource usage of every service
+// known to the container service at scrape time
+type containerCollector struct {
+	containerService ContainerService
+}
+
+func (cc *containerCollector) Collect(ctx context.Context, w *metrics.Writer) {
+	statuses, err := cc.containerService.List(ctx)
+	if err != nil {
+		log.Printf("Fail to list services for metrics: %v\n", err)
+		return
+	}
+
+	w.Family("catraia_service_state", "gauge",
+		"State of the service container, 1 for the current state.")
+	for _, status := range statuses {
+		w.Sample("catraia_service_state", 1, "service", status.ID, "state", status.State)
+	}
+
+	w.Family("catraia_service_restart_streak", "gauge",
+		"Current streak of consecutive restarts of the service task by the supervisor.")
+	for _, status := range statuses {
+		w.Sample("catraia_service_restart_streak", float64(status.Restarts), "service", status.ID)
+	}
+
+	var infos []*Info
+	for _, status := range statuses {
+		if status.State != StateRunning && status.State != StatePaused {
+			continue
+		}
+
+		info, err := cc.containerService.Info(ctx, status.ID)
+		if err != nil || info.Metrics == nil {
+			continue
+		}
+
+		infos = append(infos, info)
+	}
+
+	w.Family("catraia_container_cpu_seconds_total", "counter",
+		"CPU time consumed by the service task.")
+	for _, info := range infos {
+		w.Sample("catraia_container_cpu_seconds_total",
+			float64(info.Metrics.CPU.UsageNanos)/float64(time.Second), "service", info.ID)
+	}
+
+	w.Family("catraia_container_cpu_throttled_seconds_total", "counter",
+		"Time the service task was throttled by its CPU quota.")
+	for _, info := range infos {
+		w.Sample("catraia_container_cpu_throttled_seconds_total",
+			float64(info.Metrics.CPU.ThrottledNanos)/float64(time.Second), "service", info.ID)
+	}
+
+	w.Family("catraia_container_memory_usage_bytes", "gauge",
+		"Memory used by the service task.")
+	for _, info := range infos {
+		w.Sample("catraia_container_memory_usage_bytes",
+			float64(info.Metrics.Memory.UsageBytes), "service", info.ID)
+	}
+
+	w.Family("catraia_container_memory_limit_bytes", "gauge",
+		"Memory limit of the service task.")
+	for _, info := range infos {
+		w.Sample("catraia_container_memory_limit_bytes",
+			float64(info.Metrics.Memory.LimitBytes), "service", info.ID)
+	}
+
+	w.Family("catraia_container_oom_kills_total", "counter",
+		"Processes of the service task killed by the OOM killer.")
+	for _, info := range infos {
+		w.Sample("catraia_container_oom_kills_total",
+			float64(info.Metrics.Memory.OOMKills), "service", info.ID)
+	}
+
+	w.Family("catraia_container_pids", "gauge",
+		"Processes running in the service task.")
+	for _, info := range infos {
+		w.Sample("catraia_container_pids", float64(info.Metrics.Pids.Current), "service", info.ID)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl"
+)
+
+const (
+	// restart delay doubles at each consecutive failure up to maxBackoff
+	baseBackoff = time.Second
+	maxBackoff  = 5 * time.Minute
+
+	// a task running longer than resetWindow is considered healthy and
+	// its retry count is cleared on the next exit
+	resetWindow = time.Minute
+
+	// consecutive restarts after which a service is reported as
+	// crash-looping
+	crashLoopThreshold = 3
+
+	// delay before subscribing again after losing the event stream
+	resubscribeDelay = 5 * time.Second
+)
+
+type restartFunc func(ctx context.Context, id string) (string, uint32, error)
+
+type taskState struct {
+	container string
+	pid       uint32
+	startedAt time.Time
+	retries   int
+	gaveUp    bool
+	timer     *time.Timer
+}
+
+type supervisor struct {
+	conf        *ContainerdConfig
+	infoService ImageInfoService
+	restart     restartFunc
+	locks       *serviceLocks
+
+	mutex sync.Mutex
+	tasks map[string]*taskState
+}
+
+func newSupervisor(conf *ContainerdConfig, infoService ImageInfoService,
+	restart restartFunc, locks *serviceLocks) *supervisor {
+
+	return &supervisor{
+		conf:        conf,
+		infoService: infoService,
+		restart:     restart,
+		locks:       locks,
+		tasks:       make(map[string]*taskState),
+	}
+}
+
+// Run watches task exit events until ctx is done, restarting tasks
+// according to their service restart policy
+func (s *supervisor) Run(ctx context.Context) {
+	ctx = namespaces.WithNamespace(ctx, s.conf.Namespace)
+
+	for {
+		if err := s.watchEvents(ctx); err != nil {
+			log.Printf("Supervisor lost containerd events: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			s.stopTimers()
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+func (s *supervisor) watchEvents(ctx context.Context) error {
+	client, err := containerd.New(s.conf.Socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	s.adoptRunningTasks(ctx, client)
+
+	eventCh, errCh := client.Subscribe(ctx, `topic=="/tasks/exit"`,
+		fmt.Sprintf("namespace==%s", s.conf.Namespace))
+
+	for {
+		select {
+		case envelope := <-eventCh:
+			event, err := typeurl.UnmarshalAny(envelope.Event)
+			if err != nil {
+				log.Printf("Fail to decode event %s: %v\n", envelope.Topic, err)
+				continue
+			}
+
+			exit, ok := event.(*apievents.TaskExit)
+			if !ok || exit.ID != exit.ContainerID {
+				// not the init process of the task
+				continue
+			}
+
+			id, ok := s.serviceOf(exit.ContainerID)
+			if !ok {
+				continue
+			}
+
+			s.exited(ctx, id, exit.Pid, exit.ExitStatus)
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// adoptRunningTasks starts watching tasks that were already running when
+// the supervisor connected to containerd
+func (s *supervisor) adoptRunningTasks(ctx context.Context, client *containerd.Client) {
+	infos, err := s.infoService.List()
+	if err != nil {
+		log.Printf("Fail to list services: %v\n", err)
+		return
+	}
+
+	for _, info := range infos {
+		container, err := loadActiveContainer(ctx, client, info.ID)
+		if err != nil {
+			continue
+		}
+
+		task, err := container.Task(ctx, nil)
+		if err != nil {
+			continue
+		}
+
+		s.mutex.Lock()
+		if _, ok := s.tasks[info.ID]; !ok {
+			s.tasks[info.ID] = &taskState{
+				container: container.ID(),
+				pid:       task.Pid(),
+				startedAt: time.Now(),
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Watch starts supervising the task with the given pid on a container of
+// the service. Exits of any other process of the service are ignored.
+func (s *supervisor) Watch(id, containerID string, pid uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.state(id)
+	state.container = containerID
+	state.pid = pid
+	state.startedAt = time.Now()
+}
+
+// Unwatch stops supervising a service. It must be called before a task is
+// stopped on purpose so its exit is not taken for a crash.
+func (s *supervisor) Unwatch(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if state, ok := s.tasks[id]; ok {
+		state.cancelTimer()
+		delete(s.tasks, id)
+	}
+}
+
+// Restarts returns how many consecutive times a service was restarted and
+// whether it is crash-looping
+func (s *supervisor) Restarts(id string) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state, ok := s.tasks[id]
+	if !ok {
+		return 0, false
+	}
+
+	return state.retries, state.gaveUp || state.retries >= crashLoopThreshold
+}
+
+func (s *supervisor) exited(ctx context.Context, id string, pid, exitCode uint32) {
+	info, err := s.infoService.Get(id)
+	if err != nil || info == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state, ok := s.tasks[id]
+	if !ok || state.pid != pid {
+		return
+	}
+
+	state.pid = 0
+
+	if time.Since(state.startedAt) >= resetWindow {
+		state.retries = 0
+	}
+
+	if !info.Restart.shouldRestart(exitCode) {
+		log.Printf("Task of service %s exited with status %d\n", id, exitCode)
+		return
+	}
+
+	if info.Restart.MaxRetries > 0 && state.retries >= info.Restart.MaxRetries {
+		log.Printf("Service %s exceeded %d restarts, giving up\n",
+			id, info.Restart.MaxRetries)
+		state.gaveUp = true
+		return
+	}
+
+	delay := backoff(state.retries)
+	state.retries++
+
+	log.Printf("Task of service %s exited with status %d, restarting in %v\n",
+		id, exitCode, delay)
+
+	state.timer = time.AfterFunc(delay, func() {
+		s.restartTask(ctx, id, state)
+	})
+}
+
+func (s *supervisor) restartTask(ctx context.Context, id string, state *taskState) {
+	// a deploy, rollback or undeploy of the service replaces its state
+	// while holding the lock, so it is checked once the lock is taken
+	defer s.locks.lock(id)()
+
+	s.mutex.Lock()
+	if s.tasks[id] != state || state.timer == nil {
+		// service was redeployed or undeployed meanwhile
+		s.mutex.Unlock()
+		return
+	}
+	state.timer = nil
+	failedContainer := state.container
+	s.mutex.Unlock()
+
+	containerID, pid, err := s.restart(ctx, id)
+	if err != nil {
+		serviceRestartsTotal.Inc(id, "failure")
+		log.Printf("Fail to restart service %s: %v\n", id, err)
+		// a task that can not be started counts as a crash
+		s.Watch(id, failedContainer, 0)
+		s.exited(ctx, id, 0, 1)
+		return
+	}
+
+	serviceRestartsTotal.Inc(id, "success")
+	s.Watch(id, containerID, pid)
+}
+
+// serviceOf finds the service a supervised container belongs to
+func (s *supervisor) serviceOf(containerID string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, state := range s.tasks {
+		if state.container == containerID {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+func (s *supervisor) stopTimers() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, state := range s.tasks {
+		state.cancelTimer()
+	}
+}
+
+func (s *supervisor) state(id string) *taskState {
+	state, ok := s.tasks[id]
+	if !ok {
+		state = &taskState{}
+		s.tasks[id] = state
+	}
+
+	return state
+}
+
+func (ts *taskState) cancelTimer() {
+	if ts.timer != nil {
+		ts.timer.Stop()
+		ts.timer = nil
+	}
+}
+
+func (p RestartPolicy) shouldRestart(exitCode uint32) bool {
+	switch p.Policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+func backoff(retries int) time.Duration {
+	delay := baseBackoff
+	for i := 0; i < retries && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+
+	return delay
+}
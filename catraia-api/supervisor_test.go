@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/renatofq/catraia/metrics"
+)
+
+func TestShouldRestart(t *testing.T) {
+	cases := []struct {
+		policy   string
+		exitCode uint32
+		expected bool
+	}{
+		{RestartNo, 1, false},
+		{RestartOnFailure, 0, false},
+		{RestartOnFailure, 137, true},
+		{RestartAlways, 0, true},
+	}
+
+	for _, c := range cases {
+		p := RestartPolicy{Policy: c.policy}
+		if result := p.shouldRestart(c.exitCode); result != c.expected {
+			t.Errorf("policy %s exit %d want %v got %v\n",
+				c.policy, c.exitCode, c.expected, result)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	for retries, delay := range expected {
+		if result := backoff(retries); result != delay {
+			t.Errorf("retries %d want %v got %v\n", retries, delay, result)
+		}
+	}
+
+	if result := backoff(100); result != maxBackoff {
+		t.Errorf("want backoff capped at %v got %v\n", maxBackoff, result)
+	}
+}
+
+func TestRestartsTotal(t *testing.T) {
+	fail := false
+	restart := func(ctx context.Context, id string) (string, uint32, error) {
+		if fail {
+			return "", 0, errors.New("no task")
+		}
+
+		return id + "-g2", 42, nil
+	}
+
+	infos := infoMap{"restarted": &ImageInfo{ID: "restarted", Restart: RestartPolicy{Policy: RestartNo}}}
+	s := newSupervisor(nil, infos, restart, &serviceLocks{})
+
+	for _, f := range []bool{false, false, true} {
+		fail = f
+		s.Watch("restarted", "restarted-g1", 1)
+
+		state := s.state("restarted")
+		state.timer = time.AfterFunc(time.Hour, func() {})
+		state.timer.Stop()
+
+		s.restartTask(context.Background(), "restarted", state)
+	}
+
+	var out bytes.Buffer
+	if err := metrics.DefaultRegistry.Write(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`catraia_service_restarts_total{service="restarted",result="success"} 2`,
+		`catraia_service_restarts_total{service="restarted",result="failure"} 1`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("want %s in\n%s\n", expected, out.String())
+		}
+	}
+}
+
+func TestRestartAfterRedeploy(t *testing.T) {
+	restarted := make(chan string, 1)
+	restart := func(ctx context.Context, id string) (string, uint32, error) {
+		restarted <- id
+		return id + "-g2", 42, nil
+	}
+
+	infos := infoMap{"redeployed": &ImageInfo{ID: "redeployed", Restart: RestartPolicy{Policy: RestartAlways}}}
+	locks := &serviceLocks{}
+	s := newSupervisor(nil, infos, restart, locks)
+
+	s.Watch("redeployed", "redeployed-g1", 1)
+	state := s.state("redeployed")
+	state.timer = time.AfterFunc(time.Hour, func() {})
+
+	// the backoff timer fires while a deploy holds the service
+	unlock := locks.lock("redeployed")
+	done := make(chan struct{})
+	go func() {
+		s.restartTask(context.Background(), "redeployed", state)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Unwatch("redeployed")
+	s.Watch("redeployed", "redeployed-g2", 2)
+	unlock()
+
+	<-done
+	select {
+	case id := <-restarted:
+		t.Errorf("want no restart of %s after its redeploy\n", id)
+	default:
+	}
+}
@@ -88,24 +88,31 @@ func handleConnection(srcConn net.Conn, dstNet, dstAddr string) {
 	}
 	defer dstConn.Close()
 
+	tunnelConnectionsTotal.Inc()
+	tunnelActiveConnections.Inc()
+	defer tunnelActiveConnections.Dec()
+
 	var wg sync.WaitGroup
 
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		join(srcConn, dstConn)
+		join(srcConn, dstConn, "in")
 	}()
 
 	go func() {
 		defer wg.Done()
-		join(dstConn, srcConn)
+		join(dstConn, srcConn, "out")
 	}()
 
 	wg.Wait()
 }
 
-func join(src io.Reader, dst io.Writer) {
-	if _, err := io.Copy(dst, src); err != nil {
+func join(src io.Reader, dst io.Writer, direction string) {
+	n, err := io.Copy(dst, src)
+	tunnelBytesTotal.Add(float64(n), direction)
+
+	if err != nil {
 		log.Printf("Error streaming data")
 	}
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// label holding the user namespace mapping of a container as hostID:size
+const usernsLabel = "io.catraia.userns"
+
+var errUsernsExhausted = errors.New("no subordinate id range left for user namespaces")
+
+// IDMapping maps the ids of a service, from zero, to a range of
+// subordinate ids of the host. The same range is used for users and groups.
+type IDMapping struct {
+	ContainerID uint32 `json:"container_id"`
+	HostID      uint32 `json:"host_id"`
+	Size        uint32 `json:"size"`
+}
+
+func (m *IDMapping) String() string {
+	return fmt.Sprintf("%d:%d", m.HostID, m.Size)
+}
+
+func parseIDMapping(label string) (*IDMapping, error) {
+	parts := strings.SplitN(label, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid id mapping %q", label)
+	}
+
+	hostID, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id mapping %q", label)
+	}
+
+	size, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id mapping %q", label)
+	}
+
+	return &IDMapping{HostID: uint32(hostID), Size: uint32(size)}, nil
+}
+
+// specOpts puts the service in a user namespace with the mapping
+func (m *IDMapping) specOpts() oci.SpecOpts {
+	mapping := []specs.LinuxIDMapping{{
+		ContainerID: m.ContainerID,
+		HostID:      m.HostID,
+		Size:        m.Size,
+	}}
+
+	return oci.WithUserNamespace(mapping, mapping)
+}
+
+// snapshotOpts creates a snapshot owned by the root of the mapping
+func (m *IDMapping) snapshotOpts(id string, image containerd.Image) containerd.NewContainerOpts {
+	return containerd.WithRemappedSnapshot(id, image, m.HostID, m.HostID)
+}
+
+// usernsPool hands out count ranges of size subordinate ids from base, one
+// for each service run in a user namespace. Ranges are kept in a file and
+// stay with their service across deploys, so files it owns in volumes
+// remain its own.
+type usernsPool struct {
+	path  string
+	base  uint32
+	size  uint32
+	count int
+
+	mutex  sync.Mutex
+	ranges map[string]int
+}
+
+func newUsernsPool(path string, base, size, count int) (*usernsPool, error) {
+	switch {
+	case base < 0:
+		return nil, errors.New("user namespace pool base must not be negative")
+	case size <= 0 || count <= 0:
+		return nil, errors.New("user namespace pool must hold a range")
+	case size > 1<<32-1 || count > 1<<32-1 ||
+		uint64(base)+uint64(size)*uint64(count) > 1<<32-1:
+		return nil, errors.New("user namespace pool exceeds the id space")
+	}
+
+	pool := &usernsPool{
+		path:   path,
+		base:   uint32(base),
+		size:   uint32(size),
+		count:  count,
+		ranges: make(map[string]int),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pool, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &pool.ranges); err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// Allocate returns the mapping of a service, taking the first free range
+// the first time
+func (p *usernsPool) Allocate(id string) (*IDMapping, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if index, ok := p.ranges[id]; ok && index < p.count {
+		return p.mapping(index), nil
+	}
+
+	used := make(map[int]bool, len(p.ranges))
+	for _, index := range p.ranges {
+		used[index] = true
+	}
+
+	for index := 0; index < p.count; index++ {
+		if used[index] {
+			continue
+		}
+
+		p.ranges[id] = index
+		if err := p.save(); err != nil {
+			delete(p.ranges, id)
+			return nil, err
+		}
+
+		return p.mapping(index), nil
+	}
+
+	return nil, errUsernsExhausted
+}
+
+// prune frees the ranges of services not among ids, the ones left in the
+// service info
+func (p *usernsPool) prune(ids []string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	keep := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+
+	pruned := make(map[string]int, len(p.ranges))
+	for id, index := range p.ranges {
+		if keep[id] {
+			pruned[id] = index
+		} else {
+			log.Printf("Freeing user namespace range of service %s\n", id)
+		}
+	}
+
+	if len(pruned) == len(p.ranges) {
+		return nil
+	}
+
+	previous := p.ranges
+	p.ranges = pruned
+	if err := p.save(); err != nil {
+		p.ranges = previous
+		return err
+	}
+
+	return nil
+}
+
+func (p *usernsPool) mapping(index int) *IDMapping {
+	return &IDMapping{
+		HostID: p.base + uint32(index)*p.size,
+		Size:   p.size,
+	}
+}
+
+// save must be called with the mutex held
+func (p *usernsPool) save() error {
+	data, err := json.MarshalIndent(p.ranges, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p.path)
+}
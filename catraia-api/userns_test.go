@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUsernsPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "userns.json")
+	pool, err := newUsernsPool(path, 100000, 65536, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helloweb, err := pool.Allocate("helloweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helloworld, err := pool.Allocate("helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if helloweb.HostID != 100000 || helloworld.HostID != 165536 {
+		t.Errorf("want 100000 and 165536 got %d and %d\n", helloweb.HostID, helloworld.HostID)
+	}
+
+	if _, err := pool.Allocate("hellodb"); err != errUsernsExhausted {
+		t.Errorf("want %v got %v\n", errUsernsExhausted, err)
+	}
+
+	reloaded, err := newUsernsPool(path, 100000, 65536, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping, err := reloaded.Allocate("helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *mapping != *helloworld {
+		t.Errorf("want %v got %v\n", helloworld, mapping)
+	}
+
+	parsed, err := parseIDMapping(mapping.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *parsed != *mapping {
+		t.Errorf("want %v got %v\n", mapping, parsed)
+	}
+
+	if _, err := newUsernsPool(path, 1<<31, 1<<16, 1<<16); err == nil {
+		t.Error("pool beyond the id space accepted")
+	}
+
+	if _, err := newUsernsPool(path, -1, 65536, 2); err == nil {
+		t.Error("pool with a negative base accepted")
+	}
+
+	if _, err := newUsernsPool(path, 100000, -65536, 2); err == nil {
+		t.Error("pool with a negative size accepted")
+	}
+
+	if err := reloaded.prune([]string{"helloworld"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hellodb, err := reloaded.Allocate("hellodb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *hellodb != *helloweb {
+		t.Errorf("want range of pruned service %v got %v\n", helloweb, hellodb)
+	}
+
+	pruned, err := newUsernsPool(path, 100000, 65536, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := pruned.ranges["helloweb"]; ok {
+		t.Errorf("want pruned range freed on disk\n")
+	}
+}
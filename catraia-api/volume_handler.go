@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/renatofq/catraia/handlers"
+)
+
+type volumeHandler struct {
+	volumeService VolumeService
+}
+
+func newVolumeHandler(volumeService VolumeService) http.Handler {
+	return &volumeHandler{volumeService}
+}
+
+func (s *volumeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		s.optionsVolumes(w, r)
+	case http.MethodGet:
+		s.getVolumes(w, r)
+	case http.MethodDelete:
+		s.deleteVolume(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *volumeHandler) optionsVolumes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, GET, DELETE")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *volumeHandler) getVolumes(w http.ResponseWriter, r *http.Request) {
+
+	volumes, err := s.volumeService.List(r.Context())
+	if err != nil {
+		log.Printf("Fail to list volumes: %v\n", err)
+		handlers.WriteError(w, http.StatusInternalServerError,
+			errors.New("fail to list volumes"))
+		return
+	}
+
+	handlers.WriteEntity(w, http.StatusOK, volumes)
+}
+
+func (s *volumeHandler) deleteVolume(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(r.URL.Path, "/volumes/")
+	if name == r.URL.Path || len(name) == 0 || strings.ContainsRune(name, '/') {
+		handlers.WriteError(w, http.StatusBadRequest, errors.New("invalid volume name"))
+		return
+	}
+
+	switch err := s.volumeService.Delete(r.Context(), name); err {
+	case nil:
+		handlers.WriteEntity(w, http.StatusOK, "volume removed")
+	case errVolumeNotFound:
+		handlers.WriteError(w, http.StatusNotFound, err)
+	case errVolumeInUse:
+		handlers.WriteError(w, http.StatusConflict, err)
+	default:
+		log.Printf("Fail to remove volume %s: %v\n", name, err)
+		handlers.WriteError(w, http.StatusInternalServerError,
+			errors.New("fail to remove volume"))
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var (
+	errVolumeNotFound = errors.New("volume not found")
+	errVolumeInUse    = errors.New("volume is used by a running service")
+)
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// recorded for volumes prepared for services outside user namespaces
+const noVolumeMapping = "none"
+
+// VolumeStatus describes a named volume: its directory, the space it takes
+// and the services declaring it
+type VolumeStatus struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Size     int64    `json:"size"`
+	Services []string `json:"services"`
+}
+
+// VolumeService lists named volumes and purges the ones no longer needed
+type VolumeService interface {
+	List(ctx context.Context) ([]*VolumeStatus, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// volumeStore keeps named volumes as directories under dir. They are
+// created on the first deploy of a service declaring them and outlive its
+// containers until deleted.
+type volumeStore struct {
+	dir         string
+	conf        *ContainerdConfig
+	infoService ImageInfoService
+
+	// inUse tells whether any of the services has a live task
+	inUse func(ctx context.Context, services []string) (bool, error)
+}
+
+func newVolumeStore(dir string, conf *ContainerdConfig,
+	infoService ImageInfoService) *volumeStore {
+
+	vs := &volumeStore{
+		dir:         dir,
+		conf:        conf,
+		infoService: infoService,
+	}
+	vs.inUse = vs.anyLiveTask
+
+	return vs
+}
+
+func (vs *volumeStore) path(name string) string {
+	return filepath.Join(vs.dir, name)
+}
+
+// mounts creates the named volumes of a service and returns the mounts of
+// its spec. Volumes of a service in a user namespace are owned by its root.
+func (vs *volumeStore) mounts(info *ImageInfo, mapping *IDMapping) ([]specs.Mount, error) {
+	mounts := make([]specs.Mount, 0, len(info.Mounts))
+	for _, m := range info.Mounts {
+		source := m.Source
+		if m.Volume != "" {
+			source = vs.path(m.Volume)
+			if err := vs.ensure(source, mapping); err != nil {
+				return nil, err
+			}
+		}
+
+		mode := "rw"
+		if m.ReadOnly {
+			mode = "ro"
+		}
+
+		mounts = append(mounts, specs.Mount{
+			Destination: m.Target,
+			Type:        "bind",
+			Source:      source,
+			Options:     []string{"rbind", mode},
+		})
+	}
+
+	return mounts, nil
+}
+
+// ensure creates a volume owned by the root of the mapping, recording the
+// mapping it was prepared with. A volume prepared with another mapping, as
+// of a service moved in or out of a user namespace or to another range,
+// has the ids of that mapping moved to the new one. Volumes from before
+// mappings were recorded keep their owners.
+func (vs *volumeStore) ensure(path string, mapping *IDMapping) error {
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
+	if err != nil && !created {
+		return err
+	}
+
+	if created {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	}
+
+	statePath := volumeMappingPath(path)
+	previous, known, err := readVolumeMapping(statePath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case created:
+		if mapping != nil {
+			if err := os.Lchown(path, int(mapping.HostID), int(mapping.HostID)); err != nil {
+				return err
+			}
+		}
+	case !known:
+	case sameMapping(previous, mapping):
+		return nil
+	default:
+		from, to, size := remapRange(previous, mapping)
+		log.Printf("Moving volume %s from ids of %d to %d\n", path, from, to)
+		if err := remapOwners(path, from, to, size); err != nil {
+			return err
+		}
+	}
+
+	return writeVolumeMapping(statePath, mapping)
+}
+
+// volumeMappingPath is the file next to a volume holding the id mapping it
+// was prepared with, never a volume as volume names do not start with a dot
+func volumeMappingPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".userns")
+}
+
+func readVolumeMapping(path string) (*IDMapping, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == noVolumeMapping {
+		return nil, true, nil
+	}
+
+	mapping, err := parseIDMapping(value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return mapping, true, nil
+}
+
+func writeVolumeMapping(path string, mapping *IDMapping) error {
+	value := noVolumeMapping
+	if mapping != nil {
+		value = mapping.String()
+	}
+
+	return ioutil.WriteFile(path, []byte(value+"\n"), 0644)
+}
+
+func sameMapping(a, b *IDMapping) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.HostID == b.HostID && a.Size == b.Size
+}
+
+// remapRange returns where the ids of a volume prepared with previous start,
+// where they go for mapping and how many of them move
+func remapRange(previous, mapping *IDMapping) (uint64, uint64, uint64) {
+	var from, to uint64
+	size := uint64(1 << 32)
+
+	if previous != nil {
+		from, size = uint64(previous.HostID), uint64(previous.Size)
+	}
+
+	if mapping != nil {
+		to = uint64(mapping.HostID)
+		if uint64(mapping.Size) < size {
+			size = uint64(mapping.Size)
+		}
+	}
+
+	return from, to, size
+}
+
+// remapOwners moves the ids in [from, from+size) of the files under path to
+// the same offsets from to
+func remapOwners(path string, from, to, size uint64) error {
+	shift := func(id uint32) int {
+		if uint64(id) >= from && uint64(id) < from+size {
+			return int(uint64(id) - from + to)
+		}
+
+		return int(id)
+	}
+
+	return filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("fail to read owner of %s", name)
+		}
+
+		uid, gid := shift(stat.Uid), shift(stat.Gid)
+		if uid == int(stat.Uid) && gid == int(stat.Gid) {
+			return nil
+		}
+
+		return os.Lchown(name, uid, gid)
+	})
+}
+
+// List reports the volumes found under the volume directory
+func (vs *volumeStore) List(ctx context.Context) ([]*VolumeStatus, error) {
+	entries, err := ioutil.ReadDir(vs.dir)
+	if os.IsNotExist(err) {
+		return []*VolumeStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := vs.users()
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := make([]*VolumeStatus, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		status := &VolumeStatus{
+			Name:     entry.Name(),
+			Path:     vs.path(entry.Name()),
+			Services: users[entry.Name()],
+		}
+
+		if status.Services == nil {
+			status.Services = []string{}
+		}
+
+		if status.Size, err = dirSize(status.Path); err != nil {
+			log.Printf("Fail to get size of volume %s: %v\n", status.Name, err)
+		}
+
+		volumes = append(volumes, status)
+	}
+
+	return volumes, nil
+}
+
+// Delete removes a volume and its data. Volumes of services with a live
+// task are kept, undeployed ones keep their container but not their task.
+func (vs *volumeStore) Delete(ctx context.Context, name string) error {
+	if !volumeNamePattern.MatchString(name) {
+		return errVolumeNotFound
+	}
+
+	path := vs.path(name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return errVolumeNotFound
+	}
+
+	users, err := vs.users()
+	if err != nil {
+		return err
+	}
+
+	if len(users[name]) > 0 {
+		inUse, err := vs.inUse(ctx, users[name])
+		if err != nil {
+			return err
+		}
+
+		if inUse {
+			return errVolumeInUse
+		}
+	}
+
+	log.Printf("Removing volume %s\n", name)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	if err := os.Remove(volumeMappingPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// users maps volume names to the services declaring them
+func (vs *volumeStore) users() (map[string][]string, error) {
+	infos, err := vs.infoService.List()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string][]string)
+	for _, info := range infos {
+		for _, m := range info.Mounts {
+			if m.Volume != "" {
+				users[m.Volume] = append(users[m.Volume], info.ID)
+			}
+		}
+	}
+
+	for _, services := range users {
+		sort.Strings(services)
+	}
+
+	return users, nil
+}
+
+func (vs *volumeStore) anyLiveTask(ctx context.Context, services []string) (bool, error) {
+	client, err := containerd.New(vs.conf.Socket)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, vs.conf.Namespace)
+
+	for _, id := range services {
+		container, err := loadActiveContainer(ctx, client, id)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		live, err := liveTask(ctx, container)
+		if err != nil || live {
+			return live, err
+		}
+	}
+
+	return false, nil
+}
+
+// liveTask tells whether a container has a task that has not exited
+func liveTask(ctx context.Context, container containerd.Container) (bool, error) {
+	task, err := container.Task(ctx, nil)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	status, err := task.Status(ctx)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch status.Status {
+	case containerd.Created, containerd.Running, containerd.Paused, containerd.Pausing:
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// dirSize sums the size of the regular files under a directory
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+)
+
+func TestVolumeMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := &ImageInfo{
+		ID: "helloweb",
+		Mounts: []Mount{
+			{Volume: "data", Target: "/data"},
+			{Source: "/etc/ssl/certs", Target: "/etc/ssl/certs", ReadOnly: true},
+		},
+	}
+	vs := newVolumeStore(dir, nil, infoMap{"helloweb": info})
+
+	mounts, err := vs.mounts(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mounts[0].Source != filepath.Join(dir, "data") || mounts[0].Options[1] != "rw" {
+		t.Errorf("want volume mounted read-write got %v\n", mounts[0])
+	}
+
+	if mounts[1].Source != "/etc/ssl/certs" || mounts[1].Options[1] != "ro" {
+		t.Errorf("want bind mounted read-only got %v\n", mounts[1])
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "data", "db"), []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	volumes, err := vs.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*VolumeStatus{{
+		Name:     "data",
+		Path:     filepath.Join(dir, "data"),
+		Size:     5,
+		Services: []string{"helloweb"},
+	}}
+	if !reflect.DeepEqual(volumes, expected) {
+		t.Errorf("want %v got %v\n", expected[0], volumes[0])
+	}
+
+	if err := vs.Delete(context.Background(), "missing"); err != errVolumeNotFound {
+		t.Errorf("want %v got %v\n", errVolumeNotFound, err)
+	}
+}
+
+type statusTask struct {
+	containerd.Task
+	status containerd.ProcessStatus
+}
+
+func (t *statusTask) Status(ctx context.Context) (containerd.Status, error) {
+	return containerd.Status{Status: t.status}, nil
+}
+
+// taskContainer has a task until it is undeployed, keeping the container
+type taskContainer struct {
+	containerd.Container
+	task containerd.Task
+}
+
+func (c *taskContainer) Task(ctx context.Context, attach cio.Attach) (containerd.Task, error) {
+	if c.task == nil {
+		return nil, errdefs.ErrNotFound
+	}
+
+	return c.task, nil
+}
+
+func TestLiveTask(t *testing.T) {
+	tests := []struct {
+		task *statusTask
+		live bool
+	}{
+		{nil, false},
+		{&statusTask{status: containerd.Created}, true},
+		{&statusTask{status: containerd.Running}, true},
+		{&statusTask{status: containerd.Paused}, true},
+		{&statusTask{status: containerd.Stopped}, false},
+	}
+
+	for _, test := range tests {
+		container := &taskContainer{}
+		if test.task != nil {
+			container.task = test.task
+		}
+
+		live, err := liveTask(context.Background(), container)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if live != test.live {
+			t.Errorf("task %v: want live %v got %v\n", test.task, test.live, live)
+		}
+	}
+}
+
+func TestVolumeDeleteAfterUndeploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catraia-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := &ImageInfo{ID: "helloweb", Mounts: []Mount{{Volume: "data", Target: "/data"}}}
+	vs := newVolumeStore(dir, nil, infoMap{"helloweb": info})
+
+	containers := map[string]*taskContainer{
+		"helloweb": {task: &statusTask{status: containerd.Running}},
+	}
+	vs.inUse = func(ctx context.Context, services []string) (bool, error) {
+		for _, id := range services {
+			if live, err := liveTask(ctx, containers[id]); err != nil || live {
+				return live, err
+			}
+		}
+
+		return false, nil
+	}
+
+	if _, err := vs.mounts(info, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vs.Delete(context.Background(), "data"); err != errVolumeInUse {
+		t.Errorf("want %v got %v\n", errVolumeInUse, err)
+	}
+
+	// undeploy deletes the task but not the container
+	containers["helloweb"].task = nil
+
+	if err := vs.Delete(context.Background(), "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "data")); !os.IsNotExist(err) {
+		t.Errorf("want volume removed got %v\n", err)
+	}
+}
+
+func TestVolumeOwners(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "catraia-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vs := newVolumeStore(dir, nil, infoMap{})
+	path := filepath.Join(dir, "data")
+	file := filepath.Join(path, "db")
+
+	owners := func() (uint32, uint32) {
+		var dirStat, fileStat syscall.Stat_t
+		syscall.Lstat(path, &dirStat)
+		syscall.Lstat(file, &fileStat)
+		return dirStat.Uid, fileStat.Uid
+	}
+
+	first := &IDMapping{HostID: 100000, Size: 65536}
+	if err := vs.ensure(path, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if root, _ := owners(); root != 100000 {
+		t.Errorf("want new volume owned by 100000 got %d\n", root)
+	}
+
+	// the service chowns its data dir to its own user, 999 in the namespace
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{path, file} {
+		if err := os.Lchown(name, 100999, 100999); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		mapping *IDMapping
+		root    uint32
+		file    uint32
+	}{
+		{first, 100999, 100999},
+		{&IDMapping{HostID: 165536, Size: 65536}, 166535, 166535},
+		{nil, 999, 999},
+		{nil, 999, 999},
+		{first, 100999, 100999},
+	}
+
+	for _, test := range tests {
+		if err := vs.ensure(path, test.mapping); err != nil {
+			t.Fatal(err)
+		}
+
+		if root, file := owners(); root != test.root || file != test.file {
+			t.Errorf("mapping %v: want owners %d and %d got %d and %d\n",
+				test.mapping, test.root, test.file, root, file)
+		}
+	}
+
+	// volumes from before mappings were recorded keep their owners
+	if err := os.Remove(volumeMappingPath(path)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vs.ensure(path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if root, file := owners(); root != 100999 || file != 100999 {
+		t.Errorf("want unrecorded volume untouched got %d and %d\n", root, file)
+	}
+
+	if err := vs.Delete(context.Background(), "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(volumeMappingPath(path)); !os.IsNotExist(err) {
+		t.Errorf("want mapping record removed with the volume got %v\n", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/renatofq/catraia/events"
+	"github.com/renatofq/catraia/handlers"
+)
+
+type endpointHandler struct {
+	store EndpointStore
+}
+
+func newEndpointHandler(store EndpointStore) http.Handler {
+	return &endpointHandler{store}
+}
+
+func (s *endpointHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		s.optionsEndpoint(w, r)
+	case http.MethodGet:
+		s.getEndpoint(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *endpointHandler) optionsEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, GET")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *endpointHandler) getEndpoint(w http.ResponseWriter, r *http.Request) {
+
+	id, ok := parseEndpointID(r.URL.Path)
+	if !ok {
+		log.Printf("Invalid endpoint id %s\n", id)
+		handlers.WriteError(w, http.StatusBadRequest, errors.New("invalid endpoint id"))
+		return
+	}
+
+	ep, err := s.store.Load(id)
+	if err != nil {
+		handlers.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	handlers.WriteEntity(w, http.StatusOK, &events.Endpoint{
+		ID:  id,
+		URL: ep.String(),
+	})
+}
+
+func parseEndpointID(path string) (string, bool) {
+	var id string
+
+	fmt.Sscanf(path, "/endpoint/%s", &id)
+
+	if len(id) == 0 || strings.ContainsRune(id, '/') {
+		return "", false
+	}
+
+	return id, true
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/renatofq/catraia/events"
 	"github.com/renatofq/catraia/handlers"
+	"github.com/renatofq/catraia/metrics"
 	"github.com/renatofq/catraia/servers"
 )
 
@@ -24,6 +25,8 @@ func NewEventServer(name, addr, cniConfDir, cniPluginDir string, store EndpointS
 	evtHandler := newEventHandler(cniConfDir, cniPluginDir, store)
 
 	mux.Handle("/container", chain.Then(evtHandler))
+	mux.Handle("/endpoint/", chain.Then(newEndpointHandler(store)))
+	mux.Handle("/metrics", metrics.Handler())
 
 	return servers.NewHTTPServer(name, addr, mux)
 }
@@ -64,10 +67,31 @@ func (s *eventHandler) postService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if evt.Type != events.ContainerCreated {
+	switch evt.Type {
+	case events.ContainerCreated:
+		s.createEndpoint(w, evt)
+	case events.ContainerRouted:
+		s.routeEndpoint(w, evt)
+	case events.ContainerRemoved:
+		s.removeEndpoint(w, evt)
+	case events.ServicePaused:
+		if err := s.store.Pause(evt.ID); err != nil {
+			log.Printf("Fail to persist paused service %s: %v\n", evt.ID, err)
+		}
+		log.Printf("Service %s paused\n", evt.ID)
+		handlers.WriteEntity(w, http.StatusOK, "Service paused")
+	case events.ServiceResumed:
+		if err := s.store.Resume(evt.ID); err != nil {
+			log.Printf("Fail to persist resumed service %s: %v\n", evt.ID, err)
+		}
+		log.Printf("Service %s resumed\n", evt.ID)
+		handlers.WriteEntity(w, http.StatusOK, "Service resumed")
+	default:
 		handlers.WriteEntity(w, http.StatusOK, "Ok")
-		return
 	}
+}
+
+func (s *eventHandler) createEndpoint(w http.ResponseWriter, evt *events.ContainerEvent) {
 
 	addrs, err := setupNetworkIf(evt.Namespace, s.cniConfDir, s.cniPluginDir)
 	if err != nil {
@@ -98,6 +122,38 @@ func (s *eventHandler) postService(w http.ResponseWriter, r *http.Request) {
 	handlers.WriteEntity(w, http.StatusOK, "Network setup ok")
 }
 
+// routeEndpoint points the service to the endpoint of a container. The
+// store entry is replaced at once, so the proxy never misses a target.
+func (s *eventHandler) routeEndpoint(w http.ResponseWriter, evt *events.ContainerEvent) {
+
+	if evt.Service == "" {
+		handlers.WriteError(w, http.StatusBadRequest, errors.New("service is missing"))
+		return
+	}
+
+	ep, err := s.store.Load(evt.ID)
+	if err != nil {
+		log.Printf("Fail to route service %s to %s: %v\n", evt.Service, evt.ID, err)
+		handlers.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	s.store.Store(evt.Service, ep)
+
+	// a new container of a service is never frozen
+	s.store.Resume(evt.Service)
+
+	log.Printf("Service %s routed to %s\n", evt.Service, ep.String())
+	handlers.WriteEntity(w, http.StatusOK, "Route ok")
+}
+
+func (s *eventHandler) removeEndpoint(w http.ResponseWriter, evt *events.ContainerEvent) {
+
+	s.store.Delete(evt.ID)
+
+	handlers.WriteEntity(w, http.StatusOK, "Endpoint removed")
+}
+
 func readEvent(r io.Reader) (*events.ContainerEvent, error) {
 	var evt events.ContainerEvent
 	decoder := json.NewDecoder(r)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/renatofq/catraia/config"
@@ -48,7 +49,7 @@ func main() {
 
 	log.Printf("bridge interface %s is up\n", conf.Bridge)
 
-	store := NewStore()
+	store := NewStore(filepath.Join(conf.RuntimeDir, "paused.json"))
 
 	proxyServer := setupProxyServer(conf, store)
 
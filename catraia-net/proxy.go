@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -19,7 +20,24 @@ func NewProxyServer(name, addr string, store EndpointStore) servers.Server {
 		Director: director(store),
 	}
 
-	return servers.NewHTTPServer(name, addr, chain.Then(reverseProxyHandler))
+	return servers.NewHTTPServer(name, addr,
+		chain.Then(metricsHandler(store, pausedHandler(store, reverseProxyHandler))))
+}
+
+// pausedHandler answers for paused services, whose frozen tasks would hold
+// requests until they are resumed
+func pausedHandler(store EndpointStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := splitTargetPath(r.URL.Path)
+		if store.Paused(id) {
+			w.Header().Set("Retry-After", "30")
+			handlers.WriteError(w, http.StatusServiceUnavailable,
+				errors.New("service is paused"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 
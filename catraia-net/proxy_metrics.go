@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/renatofq/catraia/metrics"
+)
+
+var (
+	proxyRequestsTotal = metrics.NewCounter("catraia_proxy_requests_total",
+		"Requests proxied to services by status code.", "service", "code")
+	proxyRequestDuration = metrics.NewHistogram("catraia_proxy_request_duration_seconds",
+		"Time taken to proxy a request to a service.", nil, "service")
+)
+
+// containers of a service are named after it with their generation, as in
+// helloweb-g2
+var generationPattern = regexp.MustCompile(`^(.+)-g[0-9]+$`)
+
+// statusRecorder keeps the status code written by the wrapped handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// metricsHandler counts the requests served by next per service. Requests
+// for unknown services are grouped and the ones for a container, as
+// readiness probes, counted for its service, so they can not grow the label
+// set.
+func metricsHandler(store EndpointStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		id, _ := splitTargetPath(r.URL.Path)
+		id = serviceLabel(store, id)
+
+		next.ServeHTTP(recorder, r)
+
+		proxyRequestsTotal.Inc(id, strconv.Itoa(recorder.status))
+		proxyRequestDuration.Observe(time.Since(start).Seconds(), id)
+	})
+}
+
+// serviceLabel returns the service a request target belongs to
+func serviceLabel(store EndpointStore, id string) string {
+	if _, err := store.Load(id); err != nil {
+		return "unknown"
+	}
+
+	if match := generationPattern.FindStringSubmatch(id); match != nil {
+		return match[1]
+	}
+
+	return id
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"log"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 )
 
@@ -10,14 +15,43 @@ type EndpointStore interface {
 	Load(id string) (url.URL, error)
 	Store(id string, endpoint url.URL) error
 	Delete(id string) error
+	Pause(id string) error
+	Resume(id string) error
+	Paused(id string) bool
 }
 
 type endpointMap struct {
 	m sync.Map
+
+	// services whose tasks are frozen, kept at pausedPath so they stay
+	// paused when catraia-net restarts while their tasks are still frozen
+	paused     sync.Map
+	pausedPath string
+	pausedLock sync.Mutex
 }
 
-func NewStore() EndpointStore {
-	return &endpointMap{}
+func NewStore(pausedPath string) EndpointStore {
+	em := &endpointMap{pausedPath: pausedPath}
+
+	data, err := ioutil.ReadFile(pausedPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Fail to read paused services: %v\n", err)
+		}
+		return em
+	}
+
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		log.Printf("Fail to read paused services: %v\n", err)
+		return em
+	}
+
+	for _, id := range ids {
+		em.paused.Store(id, true)
+	}
+
+	return em
 }
 
 func (em *endpointMap) Load(id string) (url.URL, error) {
@@ -39,3 +73,56 @@ func (em *endpointMap) Delete(id string) error {
 	em.m.Delete(id)
 	return nil
 }
+
+func (em *endpointMap) Pause(id string) error {
+	em.pausedLock.Lock()
+	defer em.pausedLock.Unlock()
+
+	em.paused.Store(id, true)
+	return em.savePaused()
+}
+
+func (em *endpointMap) Resume(id string) error {
+	em.pausedLock.Lock()
+	defer em.pausedLock.Unlock()
+
+	em.paused.Delete(id)
+	return em.savePaused()
+}
+
+func (em *endpointMap) Paused(id string) bool {
+	_, ok := em.paused.Load(id)
+	return ok
+}
+
+// savePaused writes the paused services through a temporary file, so a
+// crash never leaves a partial list behind
+func (em *endpointMap) savePaused() error {
+	ids := []string{}
+	em.paused.Range(func(key, _ interface{}) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(em.pausedPath), "."+filepath.Base(em.pausedPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), em.pausedPath)
+}
@@ -1,10 +1,15 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 type Config struct {
 	RuntimeDir          string
 	ImageInfoFile       string
+	RegistryConfigFile  string
 	APIServerAddr       string
 	NetServerAddr       string
 	TunnelAddr          string
@@ -14,12 +19,24 @@ type Config struct {
 	ContainerdSocket    string
 	CNIConfDir          string
 	CNIPluginDir        string
+	LogDir              string
+	LogMaxSize          int64
+	LogMaxFiles         int
+	StateDir            string
+	ImageGCInterval     time.Duration
+	ImageGCKeep         int
+	VolumeDir           string
+	UsernsBase          int
+	UsernsSize          int
+	UsernsRanges        int
+	ReconcileInterval   time.Duration
 }
 
 func New() *Config {
 	return &Config{
 		RuntimeDir:          getEnv("CATRAIA_RUNTIME_DIR", "/run/catraia"),
 		ImageInfoFile:       getEnv("CATRAIA_IMAGE_INFO_FILE", "etc/image_info.json"),
+		RegistryConfigFile:  getEnv("CATRAIA_REGISTRY_CONFIG", "etc/registries.json"),
 		APIServerAddr:       getEnv("CATRAIA_API_SERVER_ADDR", ":2077"),
 		NetServerAddr:       getEnv("CATRAIA_NET_SERVER_ADDR", "/run/catraia/event.sock"),
 		TunnelAddr:          getEnv("CATRAIA_TUNNEL_ADDR", ":2020"),
@@ -29,6 +46,17 @@ func New() *Config {
 		ContainerdSocket:    getEnv("CATRAIA_CONTAINERD_SOCKET", "/run/containerd/containerd.sock"),
 		CNIConfDir:          getEnv("CATRAIA_CNI_CONF_DIR", "etc/net.d/"),
 		CNIPluginDir:        getEnv("CATRAIA_CNI_PLUGIN_DIR", "/usr/lib/cni"),
+		LogDir:              getEnv("CATRAIA_LOG_DIR", "/run/catraia/logs"),
+		LogMaxSize:          int64(getEnvInt("CATRAIA_LOG_MAX_SIZE", 10*1024*1024)),
+		LogMaxFiles:         getEnvInt("CATRAIA_LOG_MAX_FILES", 3),
+		StateDir:            getEnv("CATRAIA_STATE_DIR", "/var/lib/catraia"),
+		ImageGCInterval:     getEnvDuration("CATRAIA_IMAGE_GC_INTERVAL", 24*time.Hour),
+		ImageGCKeep:         getEnvInt("CATRAIA_IMAGE_GC_KEEP", 1),
+		VolumeDir:           getEnv("CATRAIA_VOLUME_DIR", "/var/lib/catraia/volumes"),
+		UsernsBase:          getEnvInt("CATRAIA_USERNS_BASE", 100000),
+		UsernsSize:          getEnvInt("CATRAIA_USERNS_SIZE", 65536),
+		UsernsRanges:        getEnvInt("CATRAIA_USERNS_RANGES", 64),
+		ReconcileInterval:   getEnvDuration("CATRAIA_RECONCILE_INTERVAL", time.Minute),
 	}
 }
 
@@ -39,3 +67,23 @@ func getEnv(key, defaultValue string) string {
 
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, exists := os.LookupEnv(key); exists {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+
+	return defaultValue
+}
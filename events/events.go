@@ -2,10 +2,25 @@ package events
 
 const (
 	ContainerCreated = "CREATED"
+	ContainerRouted  = "ROUTED"
+	ContainerRemoved = "REMOVED"
+	ServicePaused    = "PAUSED"
+	ServiceResumed   = "RESUMED"
 )
 
+// ContainerEvent notifies catraia-net about a container. CREATED sets up
+// the network of the container at Namespace, ROUTED makes the proxy send
+// the traffic of Service to the endpoint of container ID and REMOVED drops
+// the endpoint of ID. PAUSED and RESUMED tell the proxy whether service
+// ID can take requests.
 type ContainerEvent struct {
 	Type      string `json:"type"`
 	ID        string `json:"id"`
-	Namespace string `json:"namespace"`
+	Namespace string `json:"namespace,omitempty"`
+	Service   string `json:"service,omitempty"`
+}
+
+type Endpoint struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
 }
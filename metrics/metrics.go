@@ -0,0 +1,354 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets, in seconds, used when none are
+// given
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Collector produces samples at scrape time
+type Collector interface {
+	Collect(ctx context.Context, w *Writer)
+}
+
+type CollectorFunc func(ctx context.Context, w *Writer)
+
+func (f CollectorFunc) Collect(ctx context.Context, w *Writer) {
+	f(ctx, w)
+}
+
+// Registry holds the metrics exported by a daemon
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []Collector
+}
+
+// DefaultRegistry is used by the package level constructors
+var DefaultRegistry = &Registry{}
+
+func (r *Registry) Register(c Collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes every registered metric in the Prometheus text format
+func (r *Registry) Write(ctx context.Context, w io.Writer) error {
+	r.mutex.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mutex.Unlock()
+
+	writer := &Writer{w: bufio.NewWriter(w)}
+	for _, c := range collectors {
+		c.Collect(ctx, writer)
+	}
+
+	return writer.w.Flush()
+}
+
+func Register(c Collector) {
+	DefaultRegistry.Register(c)
+}
+
+// Handler serves the metrics of DefaultRegistry followed by the ones read
+// from each of sources
+func Handler(sources ...func(ctx context.Context, w io.Writer) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+
+		if err := DefaultRegistry.Write(r.Context(), w); err != nil {
+			return
+		}
+
+		for _, source := range sources {
+			source(r.Context(), w)
+		}
+	})
+}
+
+// Writer formats samples
+type Writer struct {
+	w *bufio.Writer
+}
+
+// Family starts a metric family. typ is counter, gauge or histogram.
+func (w *Writer) Family(name, typ, help string) {
+	fmt.Fprintf(w.w, "# HELP %s %s\n", name, escapeHelp(help))
+	fmt.Fprintf(w.w, "# TYPE %s %s\n", name, typ)
+}
+
+// Sample writes a value. labels alternates label names and values.
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.w.WriteString(name)
+
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			fmt.Fprintf(w.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		w.w.WriteByte('}')
+	}
+
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatFloat(value))
+	w.w.WriteByte('\n')
+}
+
+// Counter is a monotonically increasing value for each combination of
+// label values
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterValue),
+	}
+
+	Register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labels: append([]string(nil), labelValues...)}
+		c.values[key] = v
+	}
+
+	v.value += delta
+}
+
+func (c *Counter) Collect(ctx context.Context, w *Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w.Family(c.name, "counter", c.help)
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		w.Sample(c.name, v.value, pairs(c.labels, v.labels)...)
+	}
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	Counter
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterValue),
+	}}
+
+	Register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.values[key] = &counterValue{
+		labels: append([]string(nil), labelValues...),
+		value:  value,
+	}
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) Collect(ctx context.Context, w *Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	w.Family(g.name, "gauge", g.help)
+	for _, key := range sortedKeys(g.values) {
+		v := g.values[key]
+		w.Sample(g.name, v.value, pairs(g.labels, v.labels)...)
+	}
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+
+	Register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+
+	v.count++
+	v.sum += value
+}
+
+func (h *Histogram) Collect(ctx context.Context, w *Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	w.Family(h.name, "histogram", h.help)
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		labels := pairs(h.labels, v.labels)
+
+		for i, bound := range h.buckets {
+			w.Sample(h.name+"_bucket", float64(v.counts[i]),
+				append(labels, "le", formatFloat(bound))...)
+		}
+
+		w.Sample(h.name+"_bucket", float64(v.count), append(labels, "le", "+Inf")...)
+		w.Sample(h.name+"_sum", v.sum, labels...)
+		w.Sample(h.name+"_count", float64(v.count), labels...)
+	}
+}
+
+func pairs(names, values []string) []string {
+	result := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		result = append(result, name, value)
+	}
+
+	return result
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+
+	switch values := m.(type) {
+	case map[string]*counterValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func escapeHelp(value string) string {
+	return helpEscaper.Replace(value)
+}
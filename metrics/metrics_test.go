@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestWriteTextFormat(t *testing.T) {
+	registry := &Registry{}
+
+	counter := &Counter{
+		name:   "requests_total",
+		help:   "Requests.",
+		labels: []string{"code"},
+		values: make(map[string]*counterValue),
+	}
+	registry.Register(counter)
+
+	histogram := &Histogram{
+		name:    "duration_seconds",
+		help:    "Duration.",
+		buckets: []float64{0.5, 1},
+		values:  make(map[string]*histogramValue),
+	}
+	registry.Register(histogram)
+
+	counter.Inc("200")
+	counter.Add(2, "500")
+	counter.Inc("200")
+	histogram.Observe(0.25)
+	histogram.Observe(2)
+
+	var buf bytes.Buffer
+	if err := registry.Write(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+requests_total{code="500"} 2
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.5"} 1
+duration_seconds_bucket{le="1"} 1
+duration_seconds_bucket{le="+Inf"} 2
+duration_seconds_sum 2.25
+duration_seconds_count 2
+`
+
+	if buf.String() != expected {
+		t.Errorf("want\n%s\ngot\n%s\n", expected, buf.String())
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if result := escapeLabel("a\"b\\c\nd"); result != `a\"b\\c\nd` {
+		t.Errorf("unexpected escaped label %s\n", result)
+	}
+}